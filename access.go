@@ -0,0 +1,180 @@
+package sshtunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// accessPolicy decides which clients may connect to a tunnel, by their
+// addresses for tcp and by their peer credentials for unix sockets.
+type accessPolicy struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	// uids and gids allowed to connect to unix sockets, any client is
+	// allowed if both are empty.
+	uids map[int]bool
+	gids map[int]bool
+}
+
+func newAccessPolicy(c TunnelConfig) (*accessPolicy, error) {
+	p := &accessPolicy{uids: make(map[int]bool), gids: make(map[int]bool)}
+	for _, s := range c.Allow {
+		n, err := parseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow %s: %w", s, err)
+		}
+		p.allow = append(p.allow, n)
+	}
+	for _, s := range c.Deny {
+		n, err := parseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny %s: %w", s, err)
+		}
+		p.deny = append(p.deny, n)
+	}
+	if (len(c.AllowUIDs) > 0 || len(c.AllowGIDs) > 0) && !peerCredSupported {
+		// every client would be denied.
+		return nil, errors.New("allow_uids and allow_gids are not supported on this platform")
+	}
+	for _, uid := range c.AllowUIDs {
+		p.uids[uid] = true
+	}
+	for _, gid := range c.AllowGIDs {
+		p.gids[gid] = true
+	}
+	return p, nil
+}
+
+// parseCIDR parses a CIDR or a single IP.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("not an IP or CIDR")
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// check returns why the client of conn is not allowed, or nil.
+func (p *accessPolicy) check(conn net.Conn) error {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		for _, n := range p.deny {
+			if n.Contains(addr.IP) {
+				return fmt.Errorf("%s denied by %s", addr.IP, n)
+			}
+		}
+		if len(p.allow) == 0 {
+			return nil
+		}
+		for _, n := range p.allow {
+			if n.Contains(addr.IP) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s not allowed", addr.IP)
+	}
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok || (len(p.uids) == 0 && len(p.gids) == 0) {
+		return nil
+	}
+	uid, gid, err := peerCred(unixConn)
+	if err != nil {
+		return fmt.Errorf("peer credentials: %w", err)
+	}
+	if p.uids[uid] || p.gids[gid] {
+		return nil
+	}
+	return fmt.Errorf("uid %d gid %d not allowed", uid, gid)
+}
+
+// socketPerm is the mode and owner of a unix socket file, -1 or 0 keep
+// them as created.
+type socketPerm struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+func newSocketPerm(c TunnelConfig) (socketPerm, error) {
+	perm := socketPerm{uid: -1, gid: -1}
+	if c.Mode != "" {
+		mode, err := strconv.ParseUint(c.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return perm, fmt.Errorf("invalid mode %s (e.g. 0660)", c.Mode)
+		}
+		perm.mode = os.FileMode(mode)
+	}
+	if c.Owner != "" {
+		uid, err := lookupID(c.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return perm, fmt.Errorf("invalid owner %s: %w", c.Owner, err)
+		}
+		perm.uid = uid
+	}
+	if c.Group != "" {
+		gid, err := lookupID(c.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return perm, fmt.Errorf("invalid group %s: %w", c.Group, err)
+		}
+		perm.gid = gid
+	}
+	return perm, nil
+}
+
+// lookupID returns the numeric id of a user or group given by id or name.
+func lookupID(s string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// isDefault reports whether the socket file keeps the default permissions.
+func (p socketPerm) isDefault() bool {
+	return p.mode == 0 && p.uid == -1 && p.gid == -1
+}
+
+// apply sets the mode and owner of the socket file at path.
+func (p socketPerm) apply(path string) error {
+	if p.mode != 0 {
+		if err := os.Chmod(path, p.mode); err != nil {
+			return err
+		}
+	}
+	if p.uid != -1 || p.gid != -1 {
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package sshtunnel
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestAccessPolicyCIDR(t *testing.T) {
+	p, err := newAccessPolicy(TunnelConfig{
+		Allow: []string{"10.0.0.0/8", "192.168.1.1", "::1"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatalf("newAccessPolicy: %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.0.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::1", true},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		conn := addrConn{addr: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 1234}}
+		if err := p.check(conn); (err == nil) != tt.allowed {
+			t.Errorf("%s: got %v, want allowed %t", tt.ip, err, tt.allowed)
+		}
+	}
+}
+
+func TestAccessPolicyPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+
+	path := filepath.Join(t.TempDir(), "test.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		if c, err := net.Dial("unix", path); err == nil {
+			defer c.Close()
+			_, _ = c.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+
+	allowed, _ := newAccessPolicy(TunnelConfig{AllowUIDs: []int{os.Getuid()}})
+	if err := allowed.check(conn); err != nil {
+		t.Errorf("own uid: got %v, want allowed", err)
+	}
+	denied, _ := newAccessPolicy(TunnelConfig{AllowUIDs: []int{os.Getuid() + 1}, AllowGIDs: []int{os.Getgid() + 1}})
+	if err := denied.check(conn); err == nil {
+		t.Errorf("other uid and gid: got allowed")
+	}
+}
+
+func TestAccessPolicyPeerCredUnsupported(t *testing.T) {
+	if runtime.GOOS == "linux" {
+		t.Skip("peer credentials are supported on linux")
+	}
+	if _, err := newAccessPolicy(TunnelConfig{AllowUIDs: []int{0}}); err == nil {
+		t.Errorf("got allow_uids accepted, want them rejected")
+	}
+}
+
+func TestSocketPermListen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sock")
+	l, err := closableListen("", "unix", path, socketPerm{mode: 0600, uid: -1, gid: -1})
+	if err != nil {
+		t.Fatalf("closableListen: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want a socket with 0600", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d files, want the temporary directory removed", len(entries))
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the socket file removed on close", err)
+	}
+}
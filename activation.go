@@ -0,0 +1,137 @@
+package sshtunnel
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation, see sd_listen_fds(3), and by ListenerFiles handovers.
+const listenFdsStart = 3
+
+// InheritedListenersEnv is the environment variable describing, as a json
+// array of ListenerFile, the listening sockets handed over to a process as
+// its file descriptors 3 and up.
+const InheritedListenersEnv = "SSHTUNNEL_LISTENERS"
+
+// ListenerFile is a listening socket of a tunnel to be handed over to another
+// process.
+type ListenerFile struct {
+	Name    string   `json:"name,omitempty"`
+	Address string   `json:"address"`
+	File    *os.File `json:"-"`
+}
+
+var activatedFiles []activatedFile
+
+// the sockets are taken over at start, before their file descriptors can be
+// inherited by proxy commands.
+func init() {
+	loadActivatedFiles()
+}
+
+// activatedFile is a listening socket passed by systemd or handed over by
+// another process. It is kept open for the lifetime of the process, so that
+// tunnels restarted by reloads can adopt it again.
+type activatedFile struct {
+	name string
+	file *os.File
+	addr net.Addr
+	// address is the bind address the socket has been listened to with by
+	// the process handing it over, empty if passed by systemd. It differs
+	// from addr for wildcard binds and unix sockets created with a mode.
+	address string
+}
+
+func loadActivatedFiles() {
+	defer func() {
+		_ = os.Unsetenv(InheritedListenersEnv)
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if env := os.Getenv(InheritedListenersEnv); env != "" {
+		var inherited []ListenerFile
+		if err := json.Unmarshal([]byte(env), &inherited); err != nil {
+			log.Printf("ERROR: decode %s: %v", InheritedListenersEnv, err)
+			return
+		}
+		for i, lf := range inherited {
+			addActivatedFile(listenFdsStart+i, lf.Name, lf.Address)
+		}
+		return
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		addActivatedFile(listenFdsStart+i, name, "")
+	}
+}
+
+func addActivatedFile(fd int, name, address string) {
+	syscall.CloseOnExec(fd)
+	file := os.NewFile(uintptr(fd), name)
+	l, err := net.FileListener(file)
+	if err != nil {
+		log.Printf("ERROR: activated socket %d (%s): %v", fd, name, err)
+		return
+	}
+	addr := l.Addr()
+	_ = l.Close()
+	activatedFiles = append(activatedFiles, activatedFile{name: name, file: file, addr: addr, address: address})
+}
+
+// activatedListener returns a listener of the socket passed by systemd which
+// is named name or bound to address, or nil if there is none.
+func activatedListener(name, address string) (net.Listener, error) {
+	for _, f := range activatedFiles {
+		if (name != "" && f.name == name) || sameAddress(f.address, address) || sameAddr(f.addr, address) {
+			// the listener has its own copy of the file descriptor, closing it
+			// leaves the activated socket open.
+			return net.FileListener(f.file)
+		}
+	}
+	return nil, nil
+}
+
+func sameAddress(a, b string) bool {
+	return a != "" && filepath.Clean(a) == filepath.Clean(b)
+}
+
+func sameAddr(addr net.Addr, address string) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil || tcpAddr.Port != addr.Port {
+			return false
+		}
+		// :port resolves to no ip, while the socket reports :: or 0.0.0.0.
+		return tcpAddr.IP.Equal(addr.IP) || unspecified(tcpAddr.IP) && unspecified(addr.IP)
+	case *net.UnixAddr:
+		return filepath.Clean(addr.Name) == filepath.Clean(address)
+	}
+	return false
+}
+
+func unspecified(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified()
+}
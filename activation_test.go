@@ -0,0 +1,221 @@
+package sshtunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// activate passes the socket of l to the process as if by systemd under
+// name, until the test ends.
+func activate(t *testing.T, l net.Listener, name string) {
+	t.Helper()
+	f, err := l.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	prev := activatedFiles
+	activatedFiles = append(activatedFiles[:len(prev):len(prev)], activatedFile{name: name, file: f, addr: l.Addr()})
+	t.Cleanup(func() {
+		activatedFiles = prev
+		f.Close()
+	})
+}
+
+// inherit hands the listener bound to address over to the process itself, as
+// an upgrade does, until the test ends. systemd leaves the address out.
+func inherit(t *testing.T, address string, systemd bool) {
+	t.Helper()
+	files, err := ListenerFiles()
+	if err != nil {
+		t.Fatalf("ListenerFiles: %v", err)
+	}
+	prev := activatedFiles
+	activatedFiles = activatedFiles[:len(prev):len(prev)]
+	t.Cleanup(func() { activatedFiles = prev })
+	for _, lf := range files {
+		if lf.Address == address {
+			fd, err := syscall.Dup(int(lf.File.Fd()))
+			if err != nil {
+				t.Fatalf("Dup: %v", err)
+			}
+			if systemd {
+				lf.Address = ""
+			}
+			addActivatedFile(fd, lf.Name, lf.Address)
+			f := activatedFiles[len(activatedFiles)-1].file
+			t.Cleanup(func() { f.Close() })
+		}
+		lf.File.Close()
+	}
+	if len(activatedFiles) == len(prev) {
+		t.Fatalf("no listener bound to %s", address)
+	}
+}
+
+func TestInheritedListener(t *testing.T) {
+	// a free port for a wildcard bind.
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	wildcard := ":" + fmt.Sprint(free.Addr().(*net.TCPAddr).Port)
+	free.Close()
+	sock := filepath.Join(t.TempDir(), "test.sock")
+
+	tests := []struct {
+		name    string
+		network string
+		address string
+		perm    socketPerm
+		systemd bool
+	}{
+		{"wildcard", "tcp", wildcard, socketPerm{uid: -1, gid: -1}, false},
+		{"wildcard from systemd", "tcp", wildcard, socketPerm{uid: -1, gid: -1}, true},
+		{"unix socket with a mode", "unix", sock, socketPerm{mode: 0600, uid: -1, gid: -1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := closableListen("", tt.network, tt.address, tt.perm)
+			if err != nil {
+				t.Fatalf("closableListen: %v", err)
+			}
+			inherit(t, tt.address, tt.systemd)
+			// the previous process stops listening once handed over.
+			l.Close()
+
+			l, err = closableListen("", tt.network, tt.address, tt.perm)
+			if err != nil {
+				t.Fatalf("closableListen after handover: %v", err)
+			}
+			defer l.Close()
+			if !l.inherited {
+				t.Fatalf("got %s listened to again, want the inherited socket adopted", tt.address)
+			}
+			dial := tt.address
+			if tt.network == "tcp" {
+				dial = "127.0.0.1" + tt.address
+			}
+			conn, err := net.Dial(tt.network, dial)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestActivatedListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer tcp.Close()
+	activate(t, tcp, "web")
+
+	sock := filepath.Join(t.TempDir(), "test.sock")
+	unix, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer unix.Close()
+	activate(t, unix, "")
+
+	tests := []struct {
+		name    string
+		address string
+		want    net.Addr
+	}{
+		{"web", "127.0.0.1:1", tcp.Addr()},
+		{"", tcp.Addr().String(), tcp.Addr()},
+		{"other", tcp.Addr().String(), tcp.Addr()},
+		{"", sock, unix.Addr()},
+		{"", "127.0.0.1:1", nil},
+		{"other", filepath.Join(filepath.Dir(sock), "other.sock"), nil},
+	}
+	for _, tt := range tests {
+		l, err := activatedListener(tt.name, tt.address)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.name, tt.address, err)
+		}
+		if tt.want == nil {
+			if l != nil {
+				t.Errorf("%s %s: got %v adopted, want none", tt.name, tt.address, l.Addr())
+			}
+			continue
+		}
+		if l == nil {
+			t.Errorf("%s %s: got none adopted, want %v", tt.name, tt.address, tt.want)
+			continue
+		}
+		if l.Addr().String() != tt.want.String() {
+			t.Errorf("%s %s: got %v adopted, want %v", tt.name, tt.address, l.Addr(), tt.want)
+		}
+		l.Close()
+	}
+}
+
+func TestClosableListenerPause(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer inner.Close()
+	activate(t, inner, "web")
+
+	l, err := closableListen("web", "", inner.Addr().String(), socketPerm{uid: -1, gid: -1})
+	if err != nil {
+		t.Fatalf("closableListen: %v", err)
+	}
+	defer l.Close()
+	if !l.inherited {
+		t.Fatalf("got a new listener, want the activated one adopted")
+	}
+	adopted := l.l
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	l.pause()
+	select {
+	case err := <-accepted:
+		if err == nil || !l.isPaused() || l.IsClosed() {
+			t.Fatalf("got Accept %v, want it to return paused", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Accept did not return once paused")
+	}
+
+	// clients wait in the backlog while paused.
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial while paused: %v", err)
+	}
+	defer conn.Close()
+
+	l.resume()
+	if l.isPaused() || l.l != adopted {
+		t.Fatalf("got the listener rebound or still paused after resume")
+	}
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Errorf("Accept after resume: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Accept did not return the client waiting in the backlog")
+	}
+}
@@ -5,38 +5,143 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
-func closableListen(address string) (*closableListener, error) {
-	var (
-		l   net.Listener
-		err error
-	)
-	if _, rErr := net.ResolveTCPAddr("tcp", address); rErr == nil {
-		l, err = net.Listen("tcp", address)
-	} else {
-		// try unix socket connection
-		// remove sock file is already exists
-		if _, err := os.Stat(address); err == nil {
-			_ = os.Remove(address)
-		}
-		if err := mkdirIfNeeded(address); err != nil {
-			return nil, fmt.Errorf("mkdir: %w", err)
+var (
+	// openListeners are the listeners not closed yet, see ListenerFiles.
+	openListenersMux sync.Mutex
+	openListeners    = make(map[*closableListener]struct{})
+)
+
+// closableListen listens to address on network, tcp or unix. The network is
+// detected from address if empty. A socket passed by systemd socket
+// activation named name or bound to address is adopted instead if any,
+// otherwise perm is applied to unix socket files.
+func closableListen(name, network, address string, perm socketPerm) (*closableListener, error) {
+	l, err := activatedListener(name, address)
+	if err != nil {
+		return nil, fmt.Errorf("activated socket: %w", err)
+	}
+	cl := &closableListener{l: l, name: name, address: address, inherited: l != nil}
+	if l == nil {
+		if cl.l, cl.unlink, err = listen(network, address, perm); err != nil {
+			return nil, err
 		}
-		l, err = net.Listen("unix", address)
 	}
+
+	openListenersMux.Lock()
+	openListeners[cl] = struct{}{}
+	openListenersMux.Unlock()
+	return cl, nil
+}
+
+// bindNetwork returns network, or detects it from address if empty.
+func bindNetwork(network, address string) string {
+	if network != "" {
+		return network
+	}
+	if _, err := net.ResolveTCPAddr("tcp", address); err == nil {
+		return "tcp"
+	}
+	return "unix"
+}
+
+// listen returns a listener to address, and the socket file to remove once
+// it is closed if the listener does not remove it itself.
+func listen(network, address string, perm socketPerm) (net.Listener, string, error) {
+	if bindNetwork(network, address) == "tcp" {
+		l, err := net.Listen("tcp", address)
+		return l, "", err
+	}
+
+	// try unix socket connection
+	// remove sock file is already exists
+	if _, err := os.Stat(address); err == nil {
+		_ = os.Remove(address)
+	}
+	if err := mkdirIfNeeded(address); err != nil {
+		return nil, "", fmt.Errorf("mkdir: %w", err)
+	}
+	if perm.isDefault() {
+		l, err := net.Listen("unix", address)
+		return l, "", err
+	}
+	l, err := listenUnixPerm(address, perm)
 	if err != nil {
+		return nil, "", err
+	}
+	return l, address, nil
+}
+
+// listenUnixPerm listens to a unix socket created in a private directory,
+// and moves it to address once perm is applied, so that it is never
+// reachable with the default permissions. The listener does not remove the
+// socket file once closed.
+func listenUnixPerm(address string, perm socketPerm) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(address), ".sock")
+	if err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// it would remove the temporary path, not address.
+	l.SetUnlinkOnClose(false)
+	if err := perm.apply(tmp); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("set socket file permissions: %w", err)
+	}
+	if err := os.Rename(tmp, address); err != nil {
+		_ = l.Close()
 		return nil, err
 	}
-	return &closableListener{l: l}, nil
+	return l, nil
+}
+
+// ListenerFiles returns copies of the listening sockets of the tunnels, to
+// hand them over to another process with InheritedListenersEnv. Unix socket
+// files are not removed anymore when the tunnels stop listening, as the
+// other process keeps listening on them.
+func ListenerFiles() ([]ListenerFile, error) {
+	openListenersMux.Lock()
+	defer openListenersMux.Unlock()
+
+	var files []ListenerFile
+	for l := range openListeners {
+		f, err := l.file()
+		if err != nil {
+			for _, lf := range files {
+				_ = lf.File.Close()
+			}
+			return nil, fmt.Errorf("listener file of %s: %w", l.address, err)
+		}
+		files = append(files, ListenerFile{Name: l.name, Address: l.address, File: f})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Address < files[j].Address })
+	return files, nil
 }
 
 type closableListener struct {
-	l net.Listener
+	l       net.Listener
+	name    string
+	address string
+	// unlink is the socket file to remove once closed, if the listener does
+	// not remove it itself.
+	unlink string
+	// inherited is set for sockets passed by systemd or handed over by
+	// another process, which keep listening even once closed.
+	inherited bool
 
 	mux    sync.RWMutex
 	closed bool
+	paused bool
 }
 
 func (l *closableListener) Accept() (net.Conn, error) {
@@ -45,9 +150,63 @@ func (l *closableListener) Accept() (net.Conn, error) {
 
 func (l *closableListener) Close() error {
 	l.mux.Lock()
+	// only the first close removes the socket file, another listener may
+	// have been bound to it since.
+	var unlink string
+	if !l.closed {
+		unlink = l.unlink
+	}
 	l.closed = true
 	l.mux.Unlock()
-	return l.l.Close()
+
+	openListenersMux.Lock()
+	delete(openListeners, l)
+	openListenersMux.Unlock()
+	err := l.l.Close()
+	if unlink != "" {
+		_ = os.Remove(unlink)
+	}
+	return err
+}
+
+// pause makes Accept return without closing the listener, until resume.
+// Connections wait in the backlog meanwhile.
+func (l *closableListener) pause() {
+	l.mux.Lock()
+	l.paused = true
+	l.mux.Unlock()
+	if d, ok := l.l.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = d.SetDeadline(time.Now())
+	}
+}
+
+func (l *closableListener) resume() {
+	l.mux.Lock()
+	l.paused = false
+	l.mux.Unlock()
+	if d, ok := l.l.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = d.SetDeadline(time.Time{})
+	}
+}
+
+func (l *closableListener) isPaused() bool {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+	return l.paused
+}
+
+func (l *closableListener) file() (*os.File, error) {
+	switch ln := l.l.(type) {
+	case *net.TCPListener:
+		return ln.File()
+	case *net.UnixListener:
+		ln.SetUnlinkOnClose(false)
+		l.mux.Lock()
+		l.unlink = ""
+		l.mux.Unlock()
+		return ln.File()
+	}
+	return nil, fmt.Errorf("unsupported listener %T", l.l)
 }
 
 func (l *closableListener) Addr() net.Addr {
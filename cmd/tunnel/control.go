@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sltc-li/sshtunnel"
+)
+
+type gatewayStatus struct {
+	Name string `json:"name,omitempty"`
+	// Key identifies the gateway among the running ones, unlike its server
+	// which several gateways may share.
+	Key string `json:"key"`
+	sshtunnel.GatewayStatus
+	Tunnels []tunnelStatus `json:"tunnels"`
+}
+
+type tunnelStatus struct {
+	sshtunnel.TunnelStatus
+	// Enabled reports whether the tunnel is up according to the config and
+	// `tunnel up` and `tunnel down`.
+	Enabled bool `json:"enabled"`
+}
+
+type daemonStatus struct {
+	Pid     int  `json:"pid"`
+	Running bool `json:"running"`
+	// Ready reports whether all tunnels are listening and gateways with
+	// connect_on_start are connected, NotReady lists what is not otherwise.
+	Ready    bool            `json:"ready"`
+	NotReady []string        `json:"not_ready,omitempty"`
+	Gateways []gatewayStatus `json:"gateways,omitempty"`
+}
+
+type controlResult struct {
+	Error string `json:"error,omitempty"`
+	// Result is the payload of a successful request.
+	Result interface{} `json:"result,omitempty"`
+}
+
+// serveControl serves the control api of a running tunnel process on a unix
+// socket, it is used by subcommands to talk to the daemon.
+func serveControl(ctx context.Context, sockFile string, starter *Starter) error {
+	if _, err := os.Stat(sockFile); err == nil {
+		_ = os.Remove(sockFile)
+	}
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		return fmt.Errorf("listen to control socket - %s: %w", sockFile, err)
+	}
+	// the socket file is removed by start, unless it has been taken over by
+	// an upgrade.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		ready, notReady := starter.ready()
+		writeJSON(w, http.StatusOK, daemonStatus{
+			Pid:      os.Getpid(),
+			Running:  true,
+			Ready:    ready,
+			NotReady: notReady,
+			Gateways: starter.status(),
+		})
+	})
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+		result, err := starter.reload()
+		if result != nil {
+			logReloadResult(result)
+		}
+		if err != nil {
+			log.Printf("ERROR: reload config: %v", err)
+			writeJSON(w, http.StatusInternalServerError, controlResult{Error: err.Error(), Result: result})
+			return
+		}
+		writeJSON(w, http.StatusOK, controlResult{Result: result})
+	})
+	mux.HandleFunc("/gateways/reconnect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+		if err := starter.reconnectGateway(r.URL.Query().Get("key"), r.URL.Query().Get("server")); err != nil {
+			writeJSON(w, http.StatusInternalServerError, controlResult{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, controlResult{})
+	})
+	mux.HandleFunc("/tunnels/toggle", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+		if err := starter.toggleTunnel(r.URL.Query().Get("bind")); err != nil {
+			writeJSON(w, http.StatusInternalServerError, controlResult{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, controlResult{})
+	})
+
+	mux.HandleFunc("/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+		starter.requestUpgrade(func(err error) {
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, controlResult{Error: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, controlResult{})
+		})
+	})
+
+	setEnabled := func(enabled bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeJSON(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+				return
+			}
+			name := r.URL.Query().Get("name")
+			result, err := starter.setEnabled(name, enabled)
+			if err != nil {
+				log.Printf("ERROR: set %s enabled=%t: %v", name, enabled, err)
+				writeJSON(w, http.StatusInternalServerError, controlResult{Error: err.Error(), Result: result})
+				return
+			}
+			for _, d := range result.Diff {
+				log.Printf("set %s enabled=%t: %s", name, enabled, d)
+			}
+			writeJSON(w, http.StatusOK, controlResult{Result: result})
+		}
+	}
+	mux.HandleFunc("/tunnels/up", setEnabled(true))
+	mux.HandleFunc("/tunnels/down", setEnabled(false))
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("ERROR: serve control socket: %v", err)
+		}
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func controlClient(sockFile string) *http.Client {
+	return &http.Client{
+		Timeout: 40 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockFile)
+			},
+		},
+	}
+}
+
+// controlGet requests path from the control socket and decodes the json
+// response into v.
+func controlGet(sockFile, path string, v interface{}) error {
+	resp, err := controlClient(sockFile).Get("http://tunnel" + path)
+	if err != nil {
+		return fmt.Errorf("request control socket - %s: %w", sockFile, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode control response: %w", err)
+	}
+	return nil
+}
+
+// controlPost posts to path of the control socket and decodes the result
+// into v if v is not nil, an error is returned if the daemon reports a
+// failure.
+func controlPost(sockFile, path string, query url.Values, v interface{}) error {
+	resp, err := controlClient(sockFile).Post("http://tunnel"+path+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return fmt.Errorf("request control socket - %s: %w", sockFile, err)
+	}
+	defer resp.Body.Close()
+
+	result := controlResult{Result: v}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decode control response: %w", err)
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return nil
+}
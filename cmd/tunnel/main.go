@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/sevlyar/go-daemon"
@@ -22,6 +28,28 @@ import (
 )
 
 func setupCli() {
+	sockFile := func(c *cli.Context) string {
+		return c.String("sockfile")
+	}
+	// pidFile is the pid file of the daemon, empty when running in the
+	// foreground.
+	pidFile := func(c *cli.Context) string {
+		if !c.Bool("daemon") {
+			return ""
+		}
+		return c.String("pidfile")
+	}
+	startOpts := func(c *cli.Context) startOptions {
+		return startOptions{
+			configFile:    c.String("config"),
+			sockFile:      sockFile(c),
+			stateFile:     c.String("statefile"),
+			watch:         c.Bool("watch"),
+			pidFile:       pidFile(c),
+			drainTimeout:  c.Duration("drain-timeout"),
+			watchdogGrace: c.Duration("watchdog-grace"),
+		}
+	}
 	dCtx := func(c *cli.Context) *daemon.Context {
 		return &daemon.Context{
 			PidFileName: c.String("pidfile"),
@@ -37,8 +65,85 @@ func setupCli() {
 			&cli.Command{
 				Name:  "status",
 				Usage: "show daemon process status",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print status in json format",
+						Value: false,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return printDaemonStatus(dCtx(c), sockFile(c), c.Bool("json"))
+				},
+			},
+			&cli.Command{
+				Name:  "top",
+				Usage: "show live dashboard of gateways and tunnels",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "specify refresh interval",
+						Value: time.Second,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					_, running, err := daemonRunning(dCtx(c))
+					if err != nil {
+						return err
+					}
+					if !running {
+						fmt.Println("daemon process not running")
+						return nil
+					}
+					return runTop(sockFile(c), c.Duration("interval"))
+				},
+			},
+			&cli.Command{
+				Name:      "up",
+				Usage:     "bring up gateways or tunnels by name, kept across daemon restarts",
+				ArgsUsage: "<name>...",
+				Action: func(c *cli.Context) error {
+					return setEnabled(dCtx(c), sockFile(c), c.Args().Slice(), true)
+				},
+			},
+			&cli.Command{
+				Name:      "down",
+				Usage:     "bring down gateways or tunnels by name, kept across daemon restarts",
+				ArgsUsage: "<name>...",
+				Action: func(c *cli.Context) error {
+					return setEnabled(dCtx(c), sockFile(c), c.Args().Slice(), false)
+				},
+			},
+			&cli.Command{
+				Name:  "list",
+				Usage: "list gateways and tunnels with their names",
+				Action: func(c *cli.Context) error {
+					return listTunnels(dCtx(c), sockFile(c))
+				},
+			},
+			&cli.Command{
+				Name:  "wait",
+				Usage: "wait until all tunnels are listening and gateways connected",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "specify how long to wait before failing",
+						Value: 30 * time.Second,
+					},
+				},
 				Action: func(c *cli.Context) error {
-					return printDaemonStatus(dCtx(c))
+					if err := waitReady(sockFile(c), c.Duration("timeout"), nil); err != nil {
+						return err
+					}
+					fmt.Println("daemon process ready")
+					return nil
+				},
+			},
+			&cli.Command{
+				Name:  "validate",
+				Usage: "validate config file",
+				Action: func(c *cli.Context) error {
+					return validateConfig(c.String("config"))
 				},
 			},
 			&cli.Command{
@@ -55,11 +160,18 @@ func setupCli() {
 					return tailDaemonLogs(dCtx(c))
 				},
 			},
+			&cli.Command{
+				Name:  "upgrade",
+				Usage: "restart daemon process with the current executable without closing listeners",
+				Action: func(c *cli.Context) error {
+					return upgradeDaemon(dCtx(c), sockFile(c))
+				},
+			},
 			&cli.Command{
 				Name:  "reload",
 				Usage: "reload config",
 				Action: func(c *cli.Context) error {
-					return reloadConfig(dCtx(c))
+					return reloadConfig(dCtx(c), sockFile(c))
 				},
 			},
 		},
@@ -76,6 +188,21 @@ func setupCli() {
 				Usage:   "daemonize tunnel",
 				Value:   false,
 			},
+			&cli.BoolFlag{
+				Name:  "watch",
+				Usage: "reload config automatically when the config file changes",
+				Value: false,
+			},
+			&cli.DurationFlag{
+				Name:  "drain-timeout",
+				Usage: "specify how long to wait for connections to finish on shutdown and reload",
+				Value: 10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "watchdog-grace",
+				Usage: "specify how long all gateways may stay failed before the systemd watchdog is not pinged anymore, 0 to always ping",
+				Value: 5 * time.Minute,
+			},
 			&cli.StringFlag{
 				Name:  "pidfile",
 				Usage: "specify pid file for daemon process",
@@ -86,10 +213,20 @@ func setupCli() {
 				Usage: "specify log file for daemon process",
 				Value: "./.tunnel.log",
 			},
+			&cli.StringFlag{
+				Name:  "sockfile",
+				Usage: "specify control socket file for daemon process",
+				Value: "./.tunnel.sock",
+			},
+			&cli.StringFlag{
+				Name:  "statefile",
+				Usage: "specify file keeping tunnels brought up or down by `tunnel up`, `tunnel down` and `tunnel top`",
+				Value: "./.tunnel.state",
+			},
 		},
 		Action: func(c *cli.Context) error {
-			if !c.Bool("daemon") {
-				return start(c.String("config"))
+			if !c.Bool("daemon") || upgrading() {
+				return start(startOpts(c))
 			}
 
 			_ = killDaemon(dCtx(c))
@@ -98,12 +235,25 @@ func setupCli() {
 				return fmt.Errorf("reborn daemon process: %w", err)
 			}
 			if p != nil {
+				// report failures of the daemon to start, such as an invalid
+				// config or a gateway failing to connect, in the exit code.
+				exitCh := make(chan error, 1)
+				go func() {
+					state, err := p.Wait()
+					if err == nil {
+						err = errors.New(state.String())
+					}
+					exitCh <- err
+				}()
+				if err := waitReady(sockFile(c), startTimeout, exitCh); err != nil {
+					return fmt.Errorf("daemon process(pid: %d) not started, see %s: %w", p.Pid, c.String("logfile"), err)
+				}
 				fmt.Printf("daemon process(pid: %d) started\n", p.Pid)
 				return nil
 			}
 			defer dCtx(c).Release()
 
-			return start(c.String("config"))
+			return start(startOpts(c))
 		},
 	}
 
@@ -121,7 +271,22 @@ func main() {
 	setupCli()
 }
 
-func start(configFile string) error {
+// startTimeout is how long `tunnel -d` waits for the daemon to be ready.
+const startTimeout = time.Minute
+
+type startOptions struct {
+	configFile   string
+	sockFile     string
+	stateFile    string
+	pidFile      string
+	watch        bool
+	drainTimeout time.Duration
+	// watchdogGrace is how long all gateways may stay failed before the
+	// systemd watchdog is not pinged anymore.
+	watchdogGrace time.Duration
+}
+
+func start(opts startOptions) error {
 	var rLimit syscall.Rlimit
 	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
 		return fmt.Errorf("get ulimit: %w", err)
@@ -134,109 +299,139 @@ func start(configFile string) error {
 		return fmt.Errorf("set ulimit: %v", err)
 	}
 
-	starter := newStarter()
-
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGHUP)
+	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	loadErrCh := make(chan error)
-	if err := starter.load(ctx, configFile, loadErrCh); err != nil {
+	starter, err := newStarter(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := starter.load(); err != nil {
+		cancel()
 		return fmt.Errorf("load config: %w", err)
 	}
 
-	stop := func() {
-		cancel()
-		time.Sleep(time.Second)
+	if err := serveControl(ctx, opts.sockFile, starter); err != nil {
+		return err
 	}
+	// the control socket belongs to the new process after an upgrade.
+	removeSockFile := true
+	defer func() {
+		if removeSockFile {
+			_ = os.Remove(opts.sockFile)
+		}
+	}()
+
+	reportUpgraded(opts.pidFile)
+	sdNotifyReady(starter)
+	go notifySystemd(ctx, starter)
+
+	// stop stops accepting and drains connections, a second signal exits
+	// without waiting for them.
+	stop := func(upgraded bool) error {
+		log.Print("shutting down, signal again to exit immediately")
+		if !upgraded {
+			sdNotify("STOPPING=1")
+		}
+		cancel()
+
+		doneCh := make(chan struct{})
+		go func() {
+			starter.shutdown()
+			close(doneCh)
+		}()
 
-	for {
 		select {
-		case err := <-loadErrCh:
-			stop()
-			return fmt.Errorf("load config: %w", err)
+		case <-doneCh:
+			return nil
 		case sig := <-sigCh:
-			switch sig {
-			case os.Interrupt, os.Kill:
-				stop()
-				return nil
-			case syscall.SIGHUP:
-				// reload config
-				if err := starter.load(ctx, configFile, loadErrCh); err != nil {
-					stop()
-					return fmt.Errorf("reload config: %w", err)
-				}
-			}
+			return fmt.Errorf("exit on %v without draining connections", sig)
 		}
 	}
-}
-
-type Starter struct {
-	config *sshtunnel.YAMLConfig
-	stop   func()
-}
-
-func newStarter() *Starter {
-	return &Starter{}
-}
-
-func (s *Starter) load(ctx context.Context, configFile string, errCh chan<- error) error {
-	config, err := loadConfig(configFile)
-	if err != nil {
-		return err
-	}
 
-	if s.config.Equals(config) {
-		log.Print("config not change")
-		return nil
+	// reload config, keep running with the current one if it is invalid.
+	reload := func() {
+		result, err := starter.reload()
+		if result != nil {
+			logReloadResult(result)
+		}
+		if err != nil {
+			log.Printf("ERROR: reload config: %v", err)
+		}
 	}
 
-	s.config = config
-
-	if s.stop != nil {
-		s.stop()
-		time.Sleep(time.Second)
+	// handOver stops accepting and drains connections once the new process
+	// of an upgrade has taken over the listeners.
+	handOver := func(p *os.Process) error {
+		log.Printf("upgraded to process(pid: %d)", p.Pid)
+		removeSockFile = false
+		return stop(true)
 	}
 
-	ctx, s.stop = context.WithCancel(ctx)
-	go s.startTunnels(ctx, errCh)
-	return nil
-}
-
-func (s *Starter) startTunnels(ctx context.Context, errCh chan<- error) {
-	if s.config == nil {
-		log.Print("not initialized")
-		return
+	// the watchdog is pinged by the main loop, so that systemd restarts the
+	// daemon if it hangs or if all of its gateways stay failed.
+	watchdog := &watchdogGate{grace: opts.watchdogGrace}
+	var watchdogCh <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdogCh = ticker.C
 	}
 
-	var wg sync.WaitGroup
-	for _, g := range s.config.Gateways {
-		gateway, err := sshtunnel.NewGateway(s.config.KeyFiles, g.Server, g.ProxyCommand)
+	var watchCh <-chan struct{}
+	if opts.watch {
+		path, err := resolveConfigFile(opts.configFile)
 		if err != nil {
-			log.Printf("ERROR: init gateway %s: %v", g.Server, err)
-			return
+			return fmt.Errorf("resolve config file: %w", err)
 		}
+		watchCh, err = watchConfigFile(ctx, path)
+		if err != nil {
+			return fmt.Errorf("watch config file: %w", err)
+		}
+	}
 
-		go gateway.KeepAlive(ctx)
-
-		for _, t := range g.Tunnels {
-			wg.Add(1)
-			go func(tunnelStr string) {
-				defer wg.Done()
-				tunnel, err := sshtunnel.NewTunnel(gateway, tunnelStr)
-				if err != nil {
-					errCh <- fmt.Errorf("init tunnel - %s: %w", tunnelStr, err)
-					return
-				}
-				if err := tunnel.Forward(ctx); err != nil {
-					errCh <- fmt.Errorf("forward tunnel - %s: %w", tunnelStr, err)
+	for {
+		select {
+		case sig := <-sigCh:
+			switch sig {
+			case os.Interrupt, os.Kill, syscall.SIGTERM:
+				return stop(false)
+			case syscall.SIGHUP:
+				reload()
+			case syscall.SIGUSR2:
+				if p, err := startUpgrade(); err != nil {
+					log.Printf("ERROR: upgrade: %v", err)
+				} else {
+					return handOver(p)
 				}
-			}(t)
+			}
+		case req := <-starter.upgradeCh:
+			p, err := startUpgrade()
+			req.err <- err
+			<-req.done
+			if err != nil {
+				log.Printf("ERROR: upgrade: %v", err)
+			} else {
+				return handOver(p)
+			}
+		case <-watchCh:
+			log.Print("config file changed")
+			reload()
+		case <-watchdogCh:
+			if watchdog.ping(starter.status(), time.Now()) {
+				sdNotify("WATCHDOG=1")
+			}
 		}
 	}
-	wg.Wait()
+}
+
+func logReloadResult(result *reloadResult) {
+	for _, d := range result.Diff {
+		log.Printf("config reloaded: %s", d)
+	}
 }
 
 func loadConfig(configFile string) (*sshtunnel.YAMLConfig, error) {
@@ -248,51 +443,175 @@ func loadConfig(configFile string) (*sshtunnel.YAMLConfig, error) {
 
 	config, err := sshtunnel.LoadConfigFile(file)
 	if err != nil {
-		return nil, fmt.Errorf("load config file: %v", err)
+		return nil, fmt.Errorf("load config file: %w", err)
 	}
 
 	return config, nil
 }
 
 func openConfigFile(configFile string) (*os.File, error) {
-	var err error
+	path, err := resolveConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// resolveConfigFile returns the path of the config file to use, trying
+// configFile, the xdg config directory and the home directory in order.
+func resolveConfigFile(configFile string) (string, error) {
 	if configFile != "" {
-		var file *os.File
-		file, err = os.Open(configFile)
+		_, err := os.Stat(configFile)
 		if err == nil {
-			return file, nil
+			return configFile, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
 		}
-	}
-
-	if err != nil && !os.IsNotExist(err) {
-		return nil, err
 	}
 
 	cfp, err := xdg.SearchConfigFile("sshtunnel/.tunnel.yml")
 	if err != nil {
 		home, err := os.UserHomeDir()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-		return os.Open(filepath.Join(home, ".tunnel.yml"))
+		return filepath.Join(home, ".tunnel.yml"), nil
 	}
 
-	return os.Open(cfp)
+	return cfp, nil
 }
 
-func printDaemonStatus(dCtx *daemon.Context) error {
+func validateConfig(configFile string) error {
+	path, err := resolveConfigFile(configFile)
+	if err != nil {
+		return fmt.Errorf("resolve config file: %w", err)
+	}
+
+	_, err = loadConfig(path)
+	var errs sshtunnel.ValidationErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, e.Line, e.Message)
+		}
+		return fmt.Errorf("%d errors in config file %s", len(errs), path)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("config file %s is valid\n", path)
+	return nil
+}
+
+func printDaemonStatus(dCtx *daemon.Context, sockFile string, asJSON bool) error {
 	process, running, err := daemonRunning(dCtx)
 	if err != nil {
 		return err
 	}
+
+	status := daemonStatus{Running: running}
+	if running {
+		status.Pid = process.Pid
+		if err := controlGet(sockFile, "/status", &status); err != nil {
+			return err
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+
 	if !running {
 		log.Print("daemon process not running")
 		return nil
 	}
 	log.Printf("daemon process(pid: %d) running\n", process.Pid)
+	printGatewayStatuses(os.Stdout, status.Gateways)
 	return nil
 }
 
+func printGatewayStatuses(out io.Writer, gateways []gatewayStatus) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	for _, g := range gateways {
+		since := "-"
+		if !g.ConnectedSince.IsZero() {
+			since = g.ConnectedSince.Format(time.RFC3339)
+		}
+		state := g.State
+		if g.OnDemand {
+			state += " (on demand)"
+		}
+		channels := strconv.FormatInt(g.Channels, 10)
+		if g.MaxChannels > 0 {
+			channels += "/" + strconv.Itoa(g.MaxChannels)
+		}
+		fmt.Fprintln(w, "GATEWAY\tSTATE\tSINCE\tREMOTE\tCHANNELS\tRECONNECTS\tLAST ERROR")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			g.Server, state, since, orDash(g.RemoteAddr), channels, g.Reconnects, orDash(g.LastError))
+		for i, pc := range g.Pool {
+			since := "-"
+			if !pc.ConnectedSince.IsZero() {
+				since = pc.ConnectedSince.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "  #%d (%s)\t%s\t%s\t%s\t%d\t%d\t%s\n",
+				i+1, g.PoolPolicy, pc.State, since, orDash(pc.RemoteAddr), pc.Channels, pc.Reconnects, orDash(pc.LastError))
+		}
+		fmt.Fprintln(w, "  TUNNEL\tSTATE\tACTIVE\tTOTAL\tDENIED\tREJECTED\tSENT/RECEIVED\tLAST ERROR")
+		for _, t := range g.Tunnels {
+			state, lastErr := t.State, t.LastError
+			if t.Health != "" && t.State != sshtunnel.TunnelUnhealthy {
+				state += " (" + t.Health + ")"
+			}
+			if t.HealthError != "" {
+				lastErr = "health check: " + t.HealthError
+			}
+			fmt.Fprintf(w, "  %s -> %s\t%s\t%d\t%d\t%d\t%d\t%s/%s\t%s\n",
+				t.DialAddr, t.BindAddr, state, t.ActiveConns, t.TotalConns, t.DeniedConns, t.RejectedConns,
+				formatBytes(t.BytesSent), formatBytes(t.BytesReceived), orDash(lastErr))
+			for _, target := range t.Targets {
+				state := "up"
+				if !target.Up {
+					state = "down"
+				}
+				if target.Health != "" {
+					state += " (" + target.Health + ")"
+				}
+				failures := fmt.Sprintf("%d dial failures", target.Failures)
+				if target.HealthError != "" {
+					failures += ", health check: " + target.HealthError
+				}
+				fmt.Fprintf(w, "    %s\t%s\t%d\t\t\t\t\t%s\n", target.Addr, state, target.ActiveConns, failures)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func killDaemon(dCtx *daemon.Context) error {
 	p, err := dCtx.Search()
 	if err != nil {
@@ -316,8 +635,8 @@ func tailDaemonLogs(dCtx *daemon.Context) error {
 	return cmd.Run()
 }
 
-func reloadConfig(dCtx *daemon.Context) error {
-	p, running, err := daemonRunning(dCtx)
+func reloadConfig(dCtx *daemon.Context, sockFile string) error {
+	_, running, err := daemonRunning(dCtx)
 	if err != nil {
 		return err
 	}
@@ -325,11 +644,150 @@ func reloadConfig(dCtx *daemon.Context) error {
 		fmt.Println("daemon process not running")
 		return nil
 	}
-	err = p.Signal(syscall.SIGHUP)
-	if err == nil {
+
+	var result reloadResult
+	err = controlPost(sockFile, "/reload", nil, &result)
+	if result.Partial {
+		fmt.Println("config partially reloaded, run reload again to retry")
+		for _, d := range result.Diff {
+			fmt.Println(d)
+		}
+	} else if result.Changed {
 		fmt.Println("config reloaded")
+		for _, d := range result.Diff {
+			fmt.Println(d)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	if !result.Changed {
+		fmt.Println("config not changed")
 	}
-	return err
+	return nil
+}
+
+// waitReady polls the daemon until it is ready, it fails once timeout
+// expires or if the daemon exits as reported by exitCh.
+func waitReady(sockFile string, timeout time.Duration, exitCh <-chan error) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		var status daemonStatus
+		err := controlGet(sockFile, "/status", &status)
+		switch {
+		case err != nil:
+			lastErr = err
+		case status.Ready:
+			return nil
+		default:
+			lastErr = fmt.Errorf("not ready: %s", strings.Join(status.NotReady, ", "))
+		}
+
+		select {
+		case <-ticker.C:
+		case err := <-exitCh:
+			return fmt.Errorf("daemon process exited: %v", err)
+		case <-timer.C:
+			return fmt.Errorf("wait for daemon process in %v: %w", timeout, lastErr)
+		}
+	}
+}
+
+// setEnabled brings the gateways or tunnels with names up or down in the
+// daemon.
+func setEnabled(dCtx *daemon.Context, sockFile string, names []string, enabled bool) error {
+	if len(names) == 0 {
+		return errors.New("no gateway or tunnel name given")
+	}
+	_, running, err := daemonRunning(dCtx)
+	if err != nil {
+		return err
+	}
+	if !running {
+		fmt.Println("daemon process not running")
+		return nil
+	}
+
+	verb := "down"
+	if enabled {
+		verb = "up"
+	}
+	for _, name := range names {
+		var result reloadResult
+		err := controlPost(sockFile, "/tunnels/"+verb, url.Values{"name": {name}}, &result)
+		for _, d := range result.Diff {
+			fmt.Println(d)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", verb, name, err)
+		}
+		if !result.Changed {
+			fmt.Printf("%s already %s\n", name, verb)
+		}
+	}
+	return nil
+}
+
+func listTunnels(dCtx *daemon.Context, sockFile string) error {
+	_, running, err := daemonRunning(dCtx)
+	if err != nil {
+		return err
+	}
+	if !running {
+		fmt.Println("daemon process not running")
+		return nil
+	}
+
+	var status daemonStatus
+	if err := controlGet(sockFile, "/status", &status); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "NAME\tGATEWAY\tTUNNEL\tENABLED\tSTATE")
+	for _, g := range status.Gateways {
+		gateway := g.Server
+		if g.Name != "" {
+			gateway = g.Name
+		}
+		for _, t := range g.Tunnels {
+			enabled := "no"
+			if t.Enabled {
+				enabled = "yes"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s -> %s\t%s\t%s\n",
+				orDash(t.Name), gateway, t.DialAddr, t.BindAddr, enabled, t.State)
+		}
+	}
+	return nil
+}
+
+func upgradeDaemon(dCtx *daemon.Context, sockFile string) error {
+	_, running, err := daemonRunning(dCtx)
+	if err != nil {
+		return err
+	}
+	if !running {
+		fmt.Println("daemon process not running")
+		return nil
+	}
+
+	if err := controlPost(sockFile, "/upgrade", nil, nil); err != nil {
+		return fmt.Errorf("upgrade daemon process: %w", err)
+	}
+	p, _, err := daemonRunning(dCtx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("daemon process upgraded (pid: %d)\n", p.Pid)
+	return nil
 }
 
 func daemonRunning(dCtx *daemon.Context) (process *os.Process, running bool, err error) {
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sltc-li/sshtunnel"
+)
+
+// listenTimeout is how long load waits for started tunnels to listen to
+// their bind addresses.
+const listenTimeout = 5 * time.Second
+
+type Starter struct {
+	ctx          context.Context
+	configFile   string
+	stateFile    string
+	drainTimeout time.Duration
+
+	// loadMux serializes loads triggered by signals and the control socket.
+	loadMux sync.Mutex
+	config  *sshtunnel.YAMLConfig
+	state   *daemonState
+
+	// upgradeCh passes upgrade requests of the control socket to the main
+	// loop.
+	upgradeCh chan upgradeRequest
+
+	mux      sync.RWMutex
+	gateways []*gatewayEntry
+}
+
+type tunnel interface {
+	Forward(ctx context.Context) error
+	SetDrainTimeout(d time.Duration)
+	SetBandwidth(upload, download int64)
+	Status() sshtunnel.TunnelStatus
+}
+
+type gatewayEntry struct {
+	// key identifies the gateway across config reloads.
+	key     string
+	config  sshtunnel.GatewayConfig
+	gateway *sshtunnel.Gateway
+	ctx     context.Context
+	cancel  func()
+	tunnels []*tunnelEntry
+}
+
+type tunnelEntry struct {
+	// key identifies the tunnel in its gateway across config reloads.
+	key    string
+	tunnel tunnel
+	config sshtunnel.TunnelConfig
+	// enabled reports whether the tunnel is up according to the config and
+	// the overrides of the state file.
+	enabled bool
+	// cancel stops forwarding, it is nil while the tunnel is stopped.
+	cancel func()
+	// done is closed when all its forwardings have drained and returned.
+	done chan struct{}
+}
+
+// reloadResult describes the outcome of a load.
+type reloadResult struct {
+	Changed bool     `json:"changed"`
+	Diff    []string `json:"diff,omitempty"`
+	// Partial is set if the changes have been applied but some tunnels or
+	// gateways failed to start, the next load retries them.
+	Partial bool `json:"partial,omitempty"`
+}
+
+func newStarter(ctx context.Context, opts startOptions) (*Starter, error) {
+	state, err := readState(opts.stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("read state file: %w", err)
+	}
+	return &Starter{
+		ctx:          ctx,
+		configFile:   opts.configFile,
+		stateFile:    opts.stateFile,
+		drainTimeout: opts.drainTimeout,
+		state:        state,
+		upgradeCh:    make(chan upgradeRequest),
+	}, nil
+}
+
+// load loads the config file and applies the changes to the running
+// gateways and tunnels. Only gateways and tunnels that have been added or
+// removed are started or stopped, the others keep their ssh connections and
+// accepted connections. Everything new is initialized before anything is
+// stopped, so the running ones are kept as is if the new config is invalid.
+// Tunnels failing to listen and gateways failing to connect on start do not
+// undo the others, the load is reported as partial and the next one retries
+// them even if the config has not changed.
+func (s *Starter) load() (*reloadResult, error) {
+	s.loadMux.Lock()
+	defer s.loadMux.Unlock()
+
+	config, err := loadConfig(s.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.Equals(config) && !s.incomplete() {
+		log.Print("config not change")
+		return &reloadResult{}, nil
+	}
+
+	p, err := s.plan(config)
+	if err != nil {
+		return nil, err
+	}
+	if p.state != nil {
+		// a stale override would apply again to a gateway or tunnel
+		// added later under the same name.
+		if err := writeState(s.stateFile, p.state); err != nil {
+			log.Printf("ERROR: prune state file: %v", err)
+		} else {
+			s.state = p.state
+		}
+	}
+	s.config = config
+	s.apply(p)
+
+	result := &reloadResult{Changed: true, Diff: p.diff}
+	var errs []string
+	if err := s.connectGateways(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := s.waitListening(listenTimeout); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		result.Partial = true
+		return result, fmt.Errorf("partially applied: %s", strings.Join(errs, "; "))
+	}
+	return result, nil
+}
+
+// incomplete reports whether a running tunnel has failed or a gateway with
+// connect_on_start is not connected, i.e. the config is not fully applied.
+func (s *Starter) incomplete() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	for _, entry := range s.gateways {
+		switch entry.gateway.Status().State {
+		case sshtunnel.GatewayIdle, sshtunnel.GatewayFailed:
+			if entry.config.ConnectOnStart {
+				return true
+			}
+		}
+		for _, te := range entry.tunnels {
+			if tunnelFailed(te) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnelFailed reports whether te has been started and failed, e.g. to
+// listen to its bind address.
+func tunnelFailed(te *tunnelEntry) bool {
+	return te.cancel != nil && te.tunnel.Status().State == sshtunnel.TunnelFailed
+}
+
+// reload loads the config file again, systemd is told about the reload if
+// it runs the daemon.
+func (s *Starter) reload() (*reloadResult, error) {
+	sdNotifyReloading()
+	defer sdNotifyReady(s)
+	return s.load()
+}
+
+// connectGateways establishes the ssh connections of gateways with
+// connect_on_start which are not connected yet, and returns the failures.
+func (s *Starter) connectGateways() error {
+	var entries []*gatewayEntry
+	s.mux.RLock()
+	for _, entry := range s.gateways {
+		if !entry.config.ConnectOnStart {
+			continue
+		}
+		switch entry.gateway.Status().State {
+		case sshtunnel.GatewayIdle, sshtunnel.GatewayFailed:
+			entries = append(entries, entry)
+		}
+	}
+	s.mux.RUnlock()
+
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	var failures []string
+	for _, entry := range entries {
+		wg.Add(1)
+		go func(entry *gatewayEntry) {
+			defer wg.Done()
+			if err := entry.gateway.Reconnect(entry.ctx); err != nil {
+				mux.Lock()
+				failures = append(failures, fmt.Sprintf("connect gateway %s: %v", entry.key, err))
+				mux.Unlock()
+			}
+		}(entry)
+	}
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// setEnabled brings the gateway or tunnel called name up or down, and keeps
+// the override in the state file. Unnamed tunnels are called by their
+// `remote -> local` form. The override of a gateway replaces the ones of its
+// tunnels.
+func (s *Starter) setEnabled(name string, enabled bool) (*reloadResult, error) {
+	s.loadMux.Lock()
+	defer s.loadMux.Unlock()
+
+	overrides := make(map[string]bool)
+	for k, v := range s.state.Enabled {
+		overrides[k] = v
+	}
+	found := false
+	for _, g := range s.config.Gateways {
+		if g.Name == name {
+			found = true
+			for _, t := range g.Tunnels {
+				delete(overrides, tunnelKey(t))
+			}
+		}
+		for _, t := range g.Tunnels {
+			found = found || tunnelKey(t) == name
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no gateway or tunnel named %s", name)
+	}
+	overrides[name] = enabled
+
+	prev := s.state
+	s.state = &daemonState{Enabled: overrides}
+	p, err := s.plan(s.config)
+	if err == nil {
+		err = writeState(s.stateFile, s.state)
+	}
+	if err != nil {
+		s.state = prev
+		return nil, err
+	}
+	s.apply(p)
+
+	result := &reloadResult{Changed: len(p.diff) > 0, Diff: p.diff}
+	return result, s.waitListening(listenTimeout)
+}
+
+// tunnelEnabled reports whether t of g is up, overrides of the tunnel take
+// precedence over the ones of its gateway and then over the config.
+func (s *Starter) tunnelEnabled(g sshtunnel.GatewayConfig, t sshtunnel.TunnelConfig) bool {
+	for _, name := range []string{tunnelKey(t), g.Name} {
+		if name == "" {
+			continue
+		}
+		if enabled, ok := s.state.Enabled[name]; ok {
+			return enabled
+		}
+	}
+	return t.IsEnabled()
+}
+
+// reloadPlan is the set of changes to turn the running gateways and tunnels
+// into the ones of a new config.
+type reloadPlan struct {
+	gateways        []*gatewayEntry
+	addedGateways   []*gatewayEntry
+	removedGateways []*gatewayEntry
+	// tunnels are the tunnels of each gateway once the plan is applied.
+	tunnels        map[*gatewayEntry][]*tunnelEntry
+	addedTunnels   map[*gatewayEntry][]*tunnelEntry
+	removedTunnels []*tunnelEntry
+	configs        map[*gatewayEntry]sshtunnel.GatewayConfig
+	tunnelConfigs  map[*tunnelEntry]sshtunnel.TunnelConfig
+	enabled        map[*tunnelEntry]bool
+	// restarted are the new tunnels of the tunnels brought up again.
+	restarted map[*tunnelEntry]tunnel
+	// state is the state without the overrides of gateways and tunnels
+	// missing from the config, nil if there are none.
+	state *daemonState
+	diff  []string
+}
+
+func (s *Starter) plan(config *sshtunnel.YAMLConfig) (*reloadPlan, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	p := &reloadPlan{
+		tunnels:       make(map[*gatewayEntry][]*tunnelEntry),
+		addedTunnels:  make(map[*gatewayEntry][]*tunnelEntry),
+		configs:       make(map[*gatewayEntry]sshtunnel.GatewayConfig),
+		tunnelConfigs: make(map[*tunnelEntry]sshtunnel.TunnelConfig),
+		enabled:       make(map[*tunnelEntry]bool),
+		restarted:     make(map[*tunnelEntry]tunnel),
+	}
+
+	// gateways are bound to key files, restart all of them if those change.
+	keyFilesChanged := s.config == nil || !reflect.DeepEqual(s.config.KeyFiles, config.KeyFiles)
+	if s.config != nil && keyFilesChanged {
+		p.diff = append(p.diff, "~ key_files")
+	}
+
+	running := make(map[string]*gatewayEntry)
+	if !keyFilesChanged {
+		for _, entry := range s.gateways {
+			running[entry.key] = entry
+		}
+	}
+
+	fail := func(err error) (*reloadPlan, error) {
+		for _, entry := range p.addedGateways {
+			_ = entry.gateway.Close()
+		}
+		return nil, err
+	}
+
+	keys := occurrenceKeys()
+	for _, g := range config.Gateways {
+		key := keys(gatewayKey(g))
+		entry, ok := running[key]
+		if !ok {
+			gateway, err := sshtunnel.NewGatewayFromConfig(config.KeyFiles, g)
+			if err != nil {
+				return fail(fmt.Errorf("init gateway %s: %w", g, err))
+			}
+			entry = &gatewayEntry{key: key, gateway: gateway}
+			p.addedGateways = append(p.addedGateways, entry)
+			p.diff = append(p.diff, "+ gateway "+key)
+		} else {
+			delete(running, key)
+			if entry.config.OnDemandIdleTimeout() != g.OnDemandIdleTimeout() {
+				p.diff = append(p.diff, "~ gateway "+key+" on_demand")
+			}
+			if entry.config.Pool != g.Pool || entry.config.PoolPolicy != g.PoolPolicy {
+				p.diff = append(p.diff, "~ gateway "+key+" pool")
+			}
+			if entry.config.MaxChannels != g.MaxChannels {
+				p.diff = append(p.diff, "~ gateway "+key+" max_channels")
+			}
+			if entry.config.UploadLimit != g.UploadLimit || entry.config.DownloadLimit != g.DownloadLimit {
+				p.diff = append(p.diff, "~ gateway "+key+" bandwidth")
+			}
+		}
+		p.gateways = append(p.gateways, entry)
+		p.configs[entry] = g
+
+		current := make(map[string]*tunnelEntry)
+		for _, te := range entry.tunnels {
+			current[te.key] = te
+		}
+
+		var tunnels []*tunnelEntry
+		changed := make(map[string]bool)
+		tunnelKeys := occurrenceKeys()
+		for _, t := range g.Tunnels {
+			tkey := tunnelKeys(tunnelKey(t))
+			enabled := s.tunnelEnabled(g, t)
+			te, ok := current[tkey]
+			// failed tunnels are restarted.
+			if ok && sameTunnel(te.config, t) && !tunnelFailed(te) {
+				delete(current, tkey)
+				tunnels = append(tunnels, te)
+				p.tunnelConfigs[te] = t
+				p.enabled[te] = enabled
+				if te.config.UploadLimit != t.UploadLimit || te.config.DownloadLimit != t.DownloadLimit {
+					p.diff = append(p.diff, fmt.Sprintf("~ tunnel %s (%s) bandwidth", t, key))
+				}
+				switch {
+				case enabled && !te.enabled:
+					if te.done != nil {
+						// the previous forwarding may still be draining and
+						// setting the state of its tunnel, start a new one.
+						tunnel, err := sshtunnel.NewTunnelFromConfig(entry.gateway, t)
+						if err != nil {
+							return fail(fmt.Errorf("init tunnel - %s: %w", t, err))
+						}
+						tunnel.SetDrainTimeout(s.drainTimeout)
+						p.restarted[te] = tunnel
+					}
+					p.addedTunnels[entry] = append(p.addedTunnels[entry], te)
+					p.diff = append(p.diff, fmt.Sprintf("~ tunnel %s (%s) up", t, key))
+				case !enabled && te.enabled:
+					p.removedTunnels = append(p.removedTunnels, te)
+					p.diff = append(p.diff, fmt.Sprintf("~ tunnel %s (%s) down", t, key))
+				}
+				continue
+			}
+
+			tunnel, err := sshtunnel.NewTunnelFromConfig(entry.gateway, t)
+			if err != nil {
+				return fail(fmt.Errorf("init tunnel - %s: %w", t, err))
+			}
+			tunnel.SetDrainTimeout(s.drainTimeout)
+			tunnels = append(tunnels, &tunnelEntry{key: tkey, tunnel: tunnel, config: t})
+			p.tunnelConfigs[tunnels[len(tunnels)-1]] = t
+			p.enabled[tunnels[len(tunnels)-1]] = enabled
+			if enabled {
+				p.addedTunnels[entry] = append(p.addedTunnels[entry], tunnels[len(tunnels)-1])
+			}
+
+			sign := "+"
+			if ok {
+				sign = "~"
+				changed[tkey] = true
+			}
+			d := fmt.Sprintf("%s tunnel %s (%s)", sign, t, key)
+			if !enabled {
+				d += " disabled"
+			}
+			p.diff = append(p.diff, d)
+		}
+		for _, te := range entry.tunnels {
+			if current[te.key] != te {
+				continue
+			}
+			p.removedTunnels = append(p.removedTunnels, te)
+			if !changed[te.key] {
+				p.diff = append(p.diff, fmt.Sprintf("- tunnel %s (%s)", te.config, key))
+			}
+		}
+		p.tunnels[entry] = tunnels
+	}
+
+	names := make(map[string]bool)
+	for _, g := range config.Gateways {
+		if g.Name != "" {
+			names[g.Name] = true
+		}
+		for _, t := range g.Tunnels {
+			names[tunnelKey(t)] = true
+		}
+	}
+	for name, enabled := range s.state.Enabled {
+		if names[name] {
+			continue
+		}
+		if p.state == nil {
+			p.state = &daemonState{Enabled: make(map[string]bool)}
+			for k, v := range s.state.Enabled {
+				p.state.Enabled[k] = v
+			}
+		}
+		delete(p.state.Enabled, name)
+		log.Printf("drop override %s=%t of the state file, %s is not in the config", name, enabled, name)
+	}
+
+	for _, entry := range s.gateways {
+		if _, ok := running[entry.key]; ok || keyFilesChanged {
+			p.removedGateways = append(p.removedGateways, entry)
+			p.diff = append(p.diff, "- gateway "+entry.key)
+			for _, te := range entry.tunnels {
+				p.diff = append(p.diff, fmt.Sprintf("- tunnel %s (%s)", te.config, entry.key))
+			}
+		}
+	}
+	return p, nil
+}
+
+// apply stops removed tunnels and gateways and then starts added ones. It
+// does not hold s.mux while waiting for the stopped tunnels to release their
+// bind addresses, so it must be called with s.loadMux held.
+func (s *Starter) apply(p *reloadPlan) {
+	s.mux.Lock()
+	for _, te := range p.removedTunnels {
+		cancelTunnel(te)
+	}
+	for _, entry := range p.removedGateways {
+		entry.cancel()
+		for _, te := range entry.tunnels {
+			cancelTunnel(te)
+		}
+	}
+	s.mux.Unlock()
+
+	for _, te := range p.removedTunnels {
+		waitUnbound(te)
+	}
+	for _, entry := range p.removedGateways {
+		for _, te := range entry.tunnels {
+			waitUnbound(te)
+		}
+		go s.closeGateway(entry)
+	}
+	// tunnels brought up again wait for their previous forwarding to
+	// release the bind address.
+	for _, tunnels := range p.addedTunnels {
+		for _, te := range tunnels {
+			waitUnbound(te)
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.gateways = p.gateways
+	for _, entry := range s.gateways {
+		entry.config = p.configs[entry]
+		entry.gateway.SetOnDemand(entry.config.OnDemandIdleTimeout())
+		entry.gateway.SetMaxChannels(entry.config.MaxChannels)
+		entry.gateway.SetPool(entry.config.Pool, entry.config.PoolPolicy)
+		// validated by plan
+		upload, download, _ := entry.config.Bandwidth()
+		entry.gateway.SetBandwidth(upload, download)
+		entry.tunnels = p.tunnels[entry]
+		for _, te := range entry.tunnels {
+			if tunnel, ok := p.restarted[te]; ok {
+				te.tunnel = tunnel
+			}
+			te.config = p.tunnelConfigs[te]
+			te.enabled = p.enabled[te]
+			upload, download, _ := te.config.Bandwidth()
+			te.tunnel.SetBandwidth(upload, download)
+		}
+	}
+	for _, entry := range p.addedGateways {
+		entry.ctx, entry.cancel = context.WithCancel(s.ctx)
+		go entry.gateway.KeepAlive(entry.ctx)
+	}
+	for _, entry := range s.gateways {
+		for _, te := range p.addedTunnels[entry] {
+			s.startTunnel(entry, te)
+		}
+	}
+}
+
+// startTunnel starts forwarding of te in background once its previous
+// forwarding has released the bind address, it must be called with s.mux
+// held.
+func (s *Starter) startTunnel(g *gatewayEntry, te *tunnelEntry) {
+	ctx, cancel := context.WithCancel(g.ctx)
+	done := make(chan struct{})
+	// the previous forwarding of a tunnel brought up again may still be
+	// draining, done waits for it too.
+	prev, tunnel, config := te.done, te.tunnel, te.config
+	te.cancel, te.done = cancel, done
+	go func() {
+		defer close(done)
+		if err := tunnel.Forward(ctx); err != nil {
+			log.Printf("ERROR: forward tunnel - %s: %v", config, err)
+		}
+		if prev != nil {
+			<-prev
+		}
+	}()
+}
+
+// cancelTunnel stops te from accepting, its accepted connections are
+// drained in background. It must be called with s.mux held.
+func cancelTunnel(te *tunnelEntry) {
+	if te.cancel != nil {
+		te.cancel()
+		te.cancel = nil
+	}
+}
+
+// waitUnbound waits for the last forwarding of te to close its bind
+// listener.
+func waitUnbound(te *tunnelEntry) {
+	if te.done == nil {
+		return
+	}
+	for {
+		switch te.tunnel.Status().State {
+		case sshtunnel.TunnelUnhealthy, sshtunnel.TunnelDraining, sshtunnel.TunnelStopped, sshtunnel.TunnelFailed:
+			return
+		}
+		select {
+		case <-te.done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// closeGateway closes the ssh connection of a stopped gateway once the
+// connections of its tunnels have been drained.
+func (s *Starter) closeGateway(entry *gatewayEntry) {
+	waitDrained(entry)
+	if err := entry.gateway.Close(); err != nil {
+		log.Printf("ERROR: close gateway %s: %v", entry.key, err)
+	}
+}
+
+func waitDrained(entry *gatewayEntry) {
+	for _, te := range entry.tunnels {
+		if te.done != nil {
+			<-te.done
+		}
+	}
+}
+
+// shutdown stops all tunnels and waits for their connections to be drained.
+// The context of the Starter must be canceled before.
+func (s *Starter) shutdown() {
+	s.mux.RLock()
+	gateways := s.gateways
+	s.mux.RUnlock()
+
+	for _, entry := range gateways {
+		waitDrained(entry)
+		_ = entry.gateway.Close()
+	}
+}
+
+// waitListening waits until every running tunnel has either started
+// listening or failed, and returns the failures.
+func (s *Starter) waitListening(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var starting []string
+		var failures []string
+		s.mux.RLock()
+		for _, entry := range s.gateways {
+			for _, te := range entry.tunnels {
+				if te.cancel == nil {
+					continue
+				}
+				switch st := te.tunnel.Status(); st.State {
+				case sshtunnel.TunnelStarting:
+					starting = append(starting, te.config.String())
+				case sshtunnel.TunnelFailed:
+					failures = append(failures, st.LastError)
+				}
+			}
+		}
+		s.mux.RUnlock()
+
+		if len(starting) == 0 || time.Now().After(deadline) {
+			if len(starting) > 0 {
+				failures = append(failures, fmt.Sprintf("tunnels not listening in %v: %s", timeout, strings.Join(starting, ", ")))
+			}
+			if len(failures) > 0 {
+				return errors.New(strings.Join(failures, "; "))
+			}
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *Starter) status() []gatewayStatus {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	statuses := make([]gatewayStatus, 0, len(s.gateways))
+	for _, entry := range s.gateways {
+		gs := gatewayStatus{
+			Name:          entry.config.Name,
+			Key:           entry.key,
+			GatewayStatus: entry.gateway.Status(),
+			Tunnels:       make([]tunnelStatus, 0, len(entry.tunnels)),
+		}
+		for _, te := range entry.tunnels {
+			ts := tunnelStatus{TunnelStatus: te.tunnel.Status(), Enabled: te.enabled}
+			if te.done == nil {
+				// never started, i.e. disabled
+				ts.State = sshtunnel.TunnelStopped
+			}
+			gs.Tunnels = append(gs.Tunnels, ts)
+		}
+		statuses = append(statuses, gs)
+	}
+	return statuses
+}
+
+// ready reports whether every running tunnel is listening and every
+// gateway with connect_on_start is connected, and what is not ready
+// otherwise.
+func (s *Starter) ready() (bool, []string) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	var notReady []string
+	for _, entry := range s.gateways {
+		if st := entry.gateway.Status(); entry.config.ConnectOnStart && st.State != sshtunnel.GatewayConnected {
+			notReady = append(notReady, fmt.Sprintf("gateway %s %s", entry.key, st.State))
+		}
+		for _, te := range entry.tunnels {
+			if te.cancel == nil {
+				continue
+			}
+			// an unhealthy tunnel has closed its listener on purpose.
+			if st := te.tunnel.Status(); st.State != sshtunnel.TunnelListening && st.State != sshtunnel.TunnelUnhealthy {
+				notReady = append(notReady, fmt.Sprintf("tunnel %s %s", te.config, st.State))
+			}
+		}
+	}
+	return len(notReady) == 0, notReady
+}
+
+// reconnectGateway drops the ssh connection of the gateway with key, or
+// with server if key is empty, and dials it again. Several gateways can have
+// the same server, e.g. through different proxy commands, in which case the
+// key is required.
+func (s *Starter) reconnectGateway(key, server string) error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	var found *gatewayEntry
+	for _, entry := range s.gateways {
+		match := entry.key == key
+		if key == "" {
+			match = entry.gateway.Status().Server == server
+		}
+		if !match {
+			continue
+		}
+		if found != nil {
+			return fmt.Errorf("several gateways with server %s, reconnect one by key", server)
+		}
+		found = entry
+	}
+	if found == nil {
+		if key != "" {
+			return fmt.Errorf("gateway %s not found", key)
+		}
+		return fmt.Errorf("gateway %s not found", server)
+	}
+	return found.gateway.Reconnect(found.ctx)
+}
+
+// toggleTunnel brings the tunnel bound to bindAddr down if it is
+// forwarding, or up otherwise. The override is kept in the state file like
+// the ones of `tunnel up` and `tunnel down`.
+func (s *Starter) toggleTunnel(bindAddr string) error {
+	s.mux.RLock()
+	_, te := s.tunnelByBindAddr(bindAddr)
+	var key string
+	var forwarding bool
+	if te != nil {
+		key, forwarding = tunnelKey(te.config), te.cancel != nil
+	}
+	s.mux.RUnlock()
+
+	if te == nil {
+		return fmt.Errorf("tunnel %s not found", bindAddr)
+	}
+	_, err := s.setEnabled(key, !forwarding)
+	return err
+}
+
+// tunnelByBindAddr returns the tunnel bound to bindAddr and its gateway, it
+// must be called with s.mux held.
+func (s *Starter) tunnelByBindAddr(bindAddr string) (*gatewayEntry, *tunnelEntry) {
+	for _, entry := range s.gateways {
+		for _, te := range entry.tunnels {
+			if te.tunnel.Status().BindAddr == bindAddr {
+				return entry, te
+			}
+		}
+	}
+	return nil, nil
+}
+
+// sameTunnel reports whether a and b only differ in settings which are
+// changed on the running tunnel, i.e. bandwidth limits.
+func sameTunnel(a, b sshtunnel.TunnelConfig) bool {
+	a.UploadLimit, a.DownloadLimit = "", ""
+	b.UploadLimit, b.DownloadLimit = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+func tunnelKey(t sshtunnel.TunnelConfig) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.String()
+}
+
+// gatewayKey identifies a gateway by what its dialer is built from, so that
+// changing any of it restarts the gateway.
+func gatewayKey(g sshtunnel.GatewayConfig) string {
+	key := g.String()
+	if g.Failover == sshtunnel.FailoverRandom {
+		key += " (" + g.Failover + ")"
+	}
+	if g.ProxyCommand != "" {
+		key += " via " + g.ProxyCommand
+	}
+	return key
+}
+
+// occurrenceKeys returns a function which makes keys unique by numbering
+// repeated occurrences of the same key.
+func occurrenceKeys() func(key string) string {
+	seen := make(map[string]int)
+	return func(key string) string {
+		seen[key]++
+		if n := seen[key]; n > 1 {
+			return fmt.Sprintf("%s #%d", key, n)
+		}
+		return key
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestKey writes a new private key to path.
+func writeTestKey(t *testing.T, path string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	buf := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// newTestStarter returns a Starter of the config file in dir, and a function
+// stopping it. Its gateways are never connected, as no test dials through
+// them.
+func newTestStarter(t *testing.T, dir string) (*Starter, func()) {
+	t.Helper()
+	_ = os.Unsetenv("SSH_AUTH_SOCK")
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := newStarter(ctx, startOptions{
+		configFile:   filepath.Join(dir, ".tunnel.yml"),
+		stateFile:    filepath.Join(dir, ".tunnel.state"),
+		drainTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("newStarter: %v", err)
+	}
+	return s, func() {
+		cancel()
+		s.shutdown()
+	}
+}
+
+func TestStarterPlan(t *testing.T) {
+	// busy is a port the tunnels bound to it fail to listen to.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer busy.Close()
+
+	tests := []struct {
+		name   string
+		config string
+		next   string
+		// wantDiff is the diff of the plan from config to next.
+		wantDiff []string
+		// wantReused is the number of tunnels kept running as is.
+		wantReused int
+	}{
+		{
+			name: "tunnel added",
+			config: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {dir}/a.sock
+`,
+			next: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {dir}/a.sock
+      - 127.0.0.1:7777 -> {dir}/b.sock
+`,
+			wantDiff:   []string{"+ tunnel 127.0.0.1:7777 -> {dir}/b.sock (user@127.0.0.1:1)"},
+			wantReused: 1,
+		},
+		{
+			name: "tunnel removed",
+			config: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {dir}/a.sock
+      - 127.0.0.1:7777 -> {dir}/b.sock
+`,
+			next: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {dir}/a.sock
+`,
+			wantDiff:   []string{"- tunnel 127.0.0.1:7777 -> {dir}/b.sock (user@127.0.0.1:1)"},
+			wantReused: 1,
+		},
+		{
+			name: "tunnel changed",
+			config: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - name: a
+        remote: 127.0.0.1:7777
+        local: {dir}/a.sock
+      - 127.0.0.1:7777 -> {dir}/b.sock
+`,
+			next: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - name: a
+        remote: 127.0.0.1:7778
+        local: {dir}/a.sock
+      - 127.0.0.1:7777 -> {dir}/b.sock
+`,
+			wantDiff:   []string{"~ tunnel 127.0.0.1:7778 -> {dir}/a.sock (user@127.0.0.1:1)"},
+			wantReused: 1,
+		},
+		{
+			name: "bandwidth changed",
+			config: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - remote: 127.0.0.1:7777
+        local: {dir}/a.sock
+        upload_limit: 1M
+`,
+			next: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    upload_limit: 10M
+    tunnels:
+      - remote: 127.0.0.1:7777
+        local: {dir}/a.sock
+        upload_limit: 2M
+`,
+			wantDiff: []string{
+				"~ gateway user@127.0.0.1:1 bandwidth",
+				"~ tunnel 127.0.0.1:7777 -> {dir}/a.sock (user@127.0.0.1:1) bandwidth",
+			},
+			wantReused: 1,
+		},
+		{
+			name: "key files changed",
+			config: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {dir}/a.sock
+`,
+			next: `
+key_files: [{key2}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {dir}/a.sock
+`,
+			wantDiff: []string{
+				"~ key_files",
+				"+ gateway user@127.0.0.1:1",
+				"+ tunnel 127.0.0.1:7777 -> {dir}/a.sock (user@127.0.0.1:1)",
+				"- gateway user@127.0.0.1:1",
+				"- tunnel 127.0.0.1:7777 -> {dir}/a.sock (user@127.0.0.1:1)",
+			},
+		},
+		{
+			name: "failed tunnel retried",
+			config: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {busy}
+      - 127.0.0.1:7777 -> {dir}/a.sock
+`,
+			next: `
+key_files: [{key1}]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - 127.0.0.1:7777 -> {busy}
+      - 127.0.0.1:7777 -> {dir}/a.sock
+`,
+			wantDiff:   []string{"~ tunnel 127.0.0.1:7777 -> {busy} (user@127.0.0.1:1)"},
+			wantReused: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "starter")
+			if err != nil {
+				t.Fatalf("TempDir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			writeTestKey(t, filepath.Join(dir, "key1"))
+			writeTestKey(t, filepath.Join(dir, "key2"))
+			expand := strings.NewReplacer(
+				"{dir}", dir,
+				"{key1}", filepath.Join(dir, "key1"),
+				"{key2}", filepath.Join(dir, "key2"),
+				"{busy}", busy.Addr().String(),
+			).Replace
+			writeConfig := func(config string) {
+				if err := ioutil.WriteFile(filepath.Join(dir, ".tunnel.yml"), []byte(expand(config)), 0600); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+
+			s, stop := newTestStarter(t, dir)
+			defer stop()
+			writeConfig(tt.config)
+			// the failed tunnel makes the load partial.
+			if _, err := s.load(); err != nil && !strings.Contains(tt.config, "{busy}") {
+				t.Fatalf("load: %v", err)
+			}
+
+			writeConfig(tt.next)
+			config, err := loadConfig(s.configFile)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			running := make(map[*tunnelEntry]bool)
+			for _, entry := range s.gateways {
+				for _, te := range entry.tunnels {
+					running[te] = true
+				}
+			}
+			p, err := s.plan(config)
+			if err != nil {
+				t.Fatalf("plan: %v", err)
+			}
+
+			var wantDiff []string
+			for _, d := range tt.wantDiff {
+				wantDiff = append(wantDiff, expand(d))
+			}
+			if !reflect.DeepEqual(p.diff, wantDiff) {
+				t.Errorf("got diff %q, want %q", p.diff, wantDiff)
+			}
+			reused := 0
+			for _, tunnels := range p.tunnels {
+				for _, te := range tunnels {
+					if running[te] {
+						reused++
+					}
+				}
+			}
+			if reused != tt.wantReused {
+				t.Errorf("got %d tunnels reused, want %d", reused, tt.wantReused)
+			}
+
+			// changes of the reused tunnels, e.g. of bandwidth, apply live.
+			s.config = config
+			s.apply(p)
+			for i, entry := range s.gateways {
+				if !reflect.DeepEqual(entry.config, config.Gateways[i]) {
+					t.Errorf("gateway %s: got config %+v, want %+v", entry.key, entry.config, config.Gateways[i])
+				}
+				for j, te := range entry.tunnels {
+					if !reflect.DeepEqual(te.config, config.Gateways[i].Tunnels[j]) {
+						t.Errorf("tunnel %s: got config %+v, want %+v", te.key, te.config, config.Gateways[i].Tunnels[j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStarterUpWhileDraining(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starter")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestKey(t, filepath.Join(dir, "key"))
+	sock := filepath.Join(dir, "a.sock")
+	// the proxy header is never sent, so the connection stays in flight
+	// until the client closes it.
+	config := `
+key_files: [` + filepath.Join(dir, "key") + `]
+gateways:
+  - server: user@127.0.0.1:1
+    tunnels:
+      - name: a
+        remote: 127.0.0.1:7777
+        local: ` + sock + `
+        accept_proxy_protocol: true
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, ".tunnel.yml"), []byte(config), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	s, stop := newTestStarter(t, dir)
+	defer stop()
+	if _, err := s.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	for s.status()[0].Tunnels[0].ActiveConns == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := s.setEnabled("a", false); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if _, err := s.setEnabled("a", true); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	// the previous forwarding finishes draining once brought up again.
+	conn.Close()
+	time.Sleep(500 * time.Millisecond)
+	if ok, notReady := s.ready(); !ok {
+		t.Errorf("got %v not ready, want the tunnel brought up again listening", notReady)
+	}
+	if _, err := net.Dial("unix", sock); err != nil {
+		t.Errorf("Dial: %v", err)
+	}
+}
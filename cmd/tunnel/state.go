@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// daemonState is the state of the daemon kept across restarts in the state
+// file.
+type daemonState struct {
+	// Enabled are the gateways and tunnels brought up or down by name with
+	// `tunnel up`, `tunnel down` and `tunnel top`, overriding the config
+	// file. Unnamed tunnels are keyed by their `remote -> local` form.
+	Enabled map[string]bool `json:"enabled,omitempty"`
+}
+
+// readState reads the state file, a missing file is an empty state.
+func readState(path string) (*daemonState, error) {
+	state := &daemonState{}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("decode state file - %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// writeState replaces the state file atomically.
+func writeState(path string, state *daemonState) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// keep the `remote -> local` keys of unnamed tunnels readable.
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(state); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
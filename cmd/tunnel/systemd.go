@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sltc-li/sshtunnel"
+)
+
+// watchdogGate ties the pings of the systemd watchdog to the gateways: they
+// stop once every gateway has been failed for longer than grace, so that
+// systemd restarts the daemon if none of them recovers. A grace of 0 always
+// pings.
+type watchdogGate struct {
+	grace time.Duration
+	// failedSince is when every gateway was first seen failed, zero if one
+	// of them is not failed.
+	failedSince time.Time
+	stopped     bool
+}
+
+// ping reports whether the watchdog should be pinged at now.
+func (w *watchdogGate) ping(gateways []gatewayStatus, now time.Time) bool {
+	failed := len(gateways) > 0
+	for _, g := range gateways {
+		failed = failed && g.State == sshtunnel.GatewayFailed
+	}
+	if !failed {
+		w.failedSince = time.Time{}
+	} else if w.failedSince.IsZero() {
+		w.failedSince = now
+	}
+
+	stop := failed && w.grace > 0 && now.Sub(w.failedSince) >= w.grace
+	if stop && !w.stopped {
+		log.Printf("ERROR: all gateways failed for %v, stop pinging the systemd watchdog", w.grace)
+	}
+	if !stop && w.stopped {
+		log.Print("a gateway recovered, pinging the systemd watchdog again")
+	}
+	w.stopped = stop
+	return !stop
+}
+
+// statusSummary counts gateways and tunnels by state, e.g.
+// "gateways: 1 connected, 1 idle; tunnels: 3 listening".
+func statusSummary(gateways []gatewayStatus) string {
+	gatewayStates := make(map[string]int)
+	tunnelStates := make(map[string]int)
+	for _, g := range gateways {
+		gatewayStates[g.State]++
+		for _, t := range g.Tunnels {
+			tunnelStates[t.State]++
+		}
+	}
+	return "gateways: " + countStates(gatewayStates) + "; tunnels: " + countStates(tunnelStates)
+}
+
+func countStates(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	states := make([]string, 0, len(counts))
+	for state := range counts {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	parts := make([]string, 0, len(states))
+	for _, state := range states {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[state], state))
+	}
+	return strings.Join(parts, ", ")
+}
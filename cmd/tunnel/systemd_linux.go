@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sdStatusInterval is how often the status line sent to systemd is updated.
+const sdStatusInterval = 10 * time.Second
+
+// sdNotify sends state to the notify socket of systemd, it does nothing if
+// the process has not been started by systemd with Type=notify.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	// abstract socket addresses starting with @ are handled by net.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Printf("ERROR: notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("ERROR: notify systemd: %v", err)
+	}
+}
+
+// sdNotifyReady tells systemd the daemon is ready along with a summary of
+// the gateways and tunnels.
+func sdNotifyReady(starter *Starter) {
+	sdNotify("READY=1\nSTATUS=" + statusSummary(starter.status()))
+}
+
+// sdNotifyReloading tells systemd a reload has begun, sdNotifyReady must be
+// called once it is done.
+func sdNotifyReloading() {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		sdNotify("RELOADING=1")
+		return
+	}
+	usec := ts.Nano() / int64(time.Microsecond)
+	sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", usec))
+}
+
+// sdWatchdogInterval returns the watchdog timeout systemd expects pings
+// within, or 0 if the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd keeps the status line of systemd up to date. The watchdog
+// is pinged by the main loop instead.
+func notifySystemd(ctx context.Context, starter *Starter) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	ticker := time.NewTicker(sdStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sdNotify("STATUS=" + statusSummary(starter.status()))
+	}
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// systemd only runs on linux, notifying it does nothing elsewhere.
+
+func sdNotify(state string) {}
+
+func sdNotifyReady(starter *Starter) {}
+
+func sdNotifyReloading() {}
+
+func sdWatchdogInterval() time.Duration {
+	return 0
+}
+
+func notifySystemd(ctx context.Context, starter *Starter) {}
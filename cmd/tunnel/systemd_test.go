@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sltc-li/sshtunnel"
+)
+
+func TestWatchdogGate(t *testing.T) {
+	gateway := func(state string) gatewayStatus {
+		return gatewayStatus{GatewayStatus: sshtunnel.GatewayStatus{State: state}}
+	}
+	failed := []gatewayStatus{gateway(sshtunnel.GatewayFailed), gateway(sshtunnel.GatewayFailed)}
+	oneFailed := []gatewayStatus{gateway(sshtunnel.GatewayFailed), gateway(sshtunnel.GatewayConnected)}
+	start := time.Now()
+
+	w := &watchdogGate{grace: time.Minute}
+	steps := []struct {
+		gateways []gatewayStatus
+		after    time.Duration
+		want     bool
+	}{
+		{oneFailed, 0, true},
+		{oneFailed, 2 * time.Minute, true},
+		{failed, 2 * time.Minute, true},
+		{failed, 3*time.Minute - time.Second, true},
+		{failed, 3 * time.Minute, false},
+		{failed, 4 * time.Minute, false},
+		// the grace starts over once a gateway recovers.
+		{oneFailed, 4 * time.Minute, true},
+		{failed, 5 * time.Minute, true},
+	}
+	for i, step := range steps {
+		if got := w.ping(step.gateways, start.Add(step.after)); got != step.want {
+			t.Errorf("step %d: got ping %t, want %t", i, got, step.want)
+		}
+	}
+
+	w = &watchdogGate{}
+	if !w.ping(failed, start) || !w.ping(failed, start.Add(time.Hour)) {
+		t.Errorf("got no ping, want pings without grace")
+	}
+	if !w.ping(nil, start) {
+		t.Errorf("got no ping, want pings without gateways")
+	}
+}
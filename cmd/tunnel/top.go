@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/sltc-li/sshtunnel"
+)
+
+const (
+	sparklineWidth = 30
+
+	ansiClear   = "\x1b[H\x1b[2J"
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiReverse = "\x1b[7m"
+	ansiHideCur = "\x1b[?25l"
+	ansiShowCur = "\x1b[?25h"
+)
+
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+type topRow struct {
+	gateway *gatewayStatus
+	tunnel  *tunnelStatus
+}
+
+// topView keeps the state of the `tunnel top` dashboard between refreshes.
+type topView struct {
+	sockFile string
+
+	mux      sync.Mutex
+	status   daemonStatus
+	err      error
+	message  string
+	selected int
+	// throughput history in bytes per interval, keyed by bind address.
+	history   map[string][]int64
+	lastBytes map[string]int64
+}
+
+func runTop(sockFile string, interval time.Duration) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("top requires a terminal")
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("make raw terminal: %w", err)
+	}
+	defer term.Restore(fd, oldState)
+
+	fmt.Print(ansiHideCur)
+	defer fmt.Print(ansiShowCur + ansiClear)
+
+	v := &topView{
+		sockFile:  sockFile,
+		history:   make(map[string][]int64),
+		lastBytes: make(map[string]int64),
+	}
+
+	keyCh := make(chan string)
+	go readKeys(keyCh)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	v.refresh()
+	v.render()
+	for {
+		select {
+		case <-ticker.C:
+			v.refresh()
+		case key, ok := <-keyCh:
+			if !ok {
+				return nil
+			}
+			switch key {
+			case "q", "\x03":
+				return nil
+			case "up", "k":
+				v.move(-1)
+			case "down", "j":
+				v.move(1)
+			case "r":
+				v.reconnect()
+			case "t", " ":
+				v.toggle()
+			}
+		}
+		v.render()
+	}
+}
+
+func readKeys(keyCh chan<- string) {
+	defer close(keyCh)
+
+	buf := make([]byte, 8)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		switch s := string(buf[:n]); s {
+		case "\x1b[A":
+			keyCh <- "up"
+		case "\x1b[B":
+			keyCh <- "down"
+		default:
+			keyCh <- s
+		}
+	}
+}
+
+func (v *topView) refresh() {
+	var status daemonStatus
+	err := controlGet(v.sockFile, "/status", &status)
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	v.err = err
+	if err != nil {
+		return
+	}
+	v.status = status
+	for _, g := range status.Gateways {
+		for _, t := range g.Tunnels {
+			total := t.BytesSent + t.BytesReceived
+			last, ok := v.lastBytes[t.BindAddr]
+			v.lastBytes[t.BindAddr] = total
+			if !ok || total < last {
+				continue
+			}
+			h := append(v.history[t.BindAddr], total-last)
+			if len(h) > sparklineWidth {
+				h = h[len(h)-sparklineWidth:]
+			}
+			v.history[t.BindAddr] = h
+		}
+	}
+	if rows := v.rows(); v.selected >= len(rows) {
+		v.selected = len(rows) - 1
+	}
+	if v.selected < 0 {
+		v.selected = 0
+	}
+}
+
+func (v *topView) rows() []topRow {
+	var rows []topRow
+	for i := range v.status.Gateways {
+		g := &v.status.Gateways[i]
+		rows = append(rows, topRow{gateway: g})
+		for j := range g.Tunnels {
+			rows = append(rows, topRow{gateway: g, tunnel: &g.Tunnels[j]})
+		}
+	}
+	return rows
+}
+
+func (v *topView) move(delta int) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	rows := v.rows()
+	v.selected += delta
+	if v.selected >= len(rows) {
+		v.selected = len(rows) - 1
+	}
+	if v.selected < 0 {
+		v.selected = 0
+	}
+}
+
+func (v *topView) selectedRow() (topRow, bool) {
+	rows := v.rows()
+	if v.selected < 0 || v.selected >= len(rows) {
+		return topRow{}, false
+	}
+	return rows[v.selected], true
+}
+
+func (v *topView) reconnect() {
+	v.mux.Lock()
+	row, ok := v.selectedRow()
+	if !ok {
+		v.mux.Unlock()
+		return
+	}
+	server, key := row.gateway.Server, row.gateway.Key
+	v.message = fmt.Sprintf("reconnecting %s ...", server)
+	v.mux.Unlock()
+
+	// reconnecting may take a while, do not block the dashboard.
+	go func() {
+		err := controlPost(v.sockFile, "/gateways/reconnect", url.Values{"key": {key}}, nil)
+
+		v.mux.Lock()
+		defer v.mux.Unlock()
+		if err != nil {
+			v.message = fmt.Sprintf("reconnect %s: %v", server, err)
+		} else {
+			v.message = fmt.Sprintf("reconnected %s", server)
+		}
+	}()
+}
+
+func (v *topView) toggle() {
+	v.mux.Lock()
+	row, ok := v.selectedRow()
+	if !ok || row.tunnel == nil {
+		v.message = "select a tunnel to toggle"
+		v.mux.Unlock()
+		return
+	}
+	bind := row.tunnel.BindAddr
+	v.message = fmt.Sprintf("toggling %s ...", bind)
+	v.mux.Unlock()
+
+	// stopping a tunnel waits for it to drain, do not block the dashboard.
+	go func() {
+		err := controlPost(v.sockFile, "/tunnels/toggle", url.Values{"bind": {bind}}, nil)
+
+		v.mux.Lock()
+		defer v.mux.Unlock()
+		if err != nil {
+			v.message = fmt.Sprintf("toggle %s: %v", bind, err)
+		} else {
+			v.message = fmt.Sprintf("toggled %s", bind)
+		}
+	}()
+}
+
+func (v *topView) render() {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = 120
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiClear)
+	line := func(style, s string) {
+		if len([]rune(s)) > width {
+			s = string([]rune(s)[:width])
+		}
+		if style != "" {
+			s = style + s + ansiReset
+		}
+		b.WriteString(s + "\r\n")
+	}
+
+	line(ansiBold, fmt.Sprintf("tunnel top - pid %d - %s", v.status.Pid, time.Now().Format("15:04:05")))
+	if v.err != nil {
+		line(ansiRed, fmt.Sprintf("ERROR: %v", v.err))
+	}
+	line("", "")
+
+	for i, row := range v.rows() {
+		style := ""
+		var s string
+		if row.tunnel == nil {
+			g := row.gateway
+			style = stateStyle(g.State)
+			s = fmt.Sprintf("%-32s %-10s remote: %-21s reconnects: %-3d %s",
+				g.Server, g.State, orDash(g.RemoteAddr), g.Reconnects, g.LastError)
+		} else {
+			t := row.tunnel
+			style = stateStyle(t.State)
+			s = fmt.Sprintf("  %-30s %-10s conns: %3d/%-5d %9s/%-9s %s %s",
+				t.DialAddr+" -> "+t.BindAddr, t.State, t.ActiveConns, t.TotalConns,
+				formatBytes(t.BytesSent), formatBytes(t.BytesReceived),
+				sparkline(v.history[t.BindAddr]), t.LastError)
+		}
+		if i == v.selected {
+			style += ansiReverse
+		}
+		line(style, s)
+	}
+
+	line("", "")
+	if v.message != "" {
+		line(ansiYellow, v.message)
+	}
+	line("", "↑/↓ select  r reconnect gateway  t toggle tunnel  q quit")
+	fmt.Print(b.String())
+}
+
+func stateStyle(state string) string {
+	switch state {
+	case sshtunnel.GatewayFailed, sshtunnel.TunnelUnhealthy:
+		return ansiRed
+	case sshtunnel.GatewayConnected, sshtunnel.TunnelListening:
+		return ansiGreen
+	}
+	return ""
+}
+
+func sparkline(samples []int64) string {
+	var max int64
+	for _, n := range samples {
+		if n > max {
+			max = n
+		}
+	}
+
+	var b strings.Builder
+	for i := len(samples); i < sparklineWidth; i++ {
+		b.WriteRune(' ')
+	}
+	for _, n := range samples {
+		if max == 0 {
+			b.WriteRune(sparkTicks[0])
+			continue
+		}
+		b.WriteRune(sparkTicks[int(n*int64(len(sparkTicks)-1)/max)])
+	}
+	return b.String()
+}
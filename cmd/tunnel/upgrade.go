@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sltc-li/sshtunnel"
+)
+
+// upgradeReadyEnv is set for a process started by an upgrade, its value is
+// the file descriptor to report readiness on.
+const upgradeReadyEnv = "SSHTUNNEL_UPGRADE_READY_FD"
+
+// keep the readiness pipe of an upgrade from being inherited by proxy
+// commands.
+func init() {
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil {
+		syscall.CloseOnExec(fd)
+	}
+}
+
+// upgradeRequest asks the main loop to hand over to a new process, the
+// outcome is sent on err and done is closed once it has been reported.
+type upgradeRequest struct {
+	err  chan error
+	done chan struct{}
+}
+
+// requestUpgrade asks the main loop for an upgrade and calls report with its
+// outcome before the main loop goes on.
+func (s *Starter) requestUpgrade(report func(err error)) {
+	req := upgradeRequest{err: make(chan error), done: make(chan struct{})}
+	select {
+	case s.upgradeCh <- req:
+	case <-s.ctx.Done():
+		report(errors.New("shutting down"))
+		return
+	}
+	report(<-req.err)
+	close(req.done)
+}
+
+// upgrading reports whether the process has been started by an upgrade.
+func upgrading() bool {
+	return os.Getenv(upgradeReadyEnv) != ""
+}
+
+// startUpgrade starts the executable again with the listening sockets of the
+// tunnels, and waits for the new process to be ready. The new process then
+// accepts connections on them along with this one until it stops.
+func startUpgrade() (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("find executable: %w", err)
+	}
+
+	listeners, err := sshtunnel.ListenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, l := range listeners {
+			_ = l.File.Close()
+		}
+	}()
+	desc, err := json.Marshal(listeners)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for _, l := range listeners {
+		files = append(files, l.File)
+	}
+	files = append(files, w)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sshtunnel.InheritedListenersEnv+"=") && !strings.HasPrefix(kv, upgradeReadyEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		sshtunnel.InheritedListenersEnv+"="+string(desc),
+		upgradeReadyEnv+"="+strconv.Itoa(len(files)-1),
+	)
+
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	})
+	w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("start %s: %w", exe, err)
+	}
+
+	readyCh := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(r).ReadString('\n')
+		switch {
+		case err == io.EOF:
+			err = errors.New("exited before being ready")
+		case err == nil && line != "ready\n":
+			err = fmt.Errorf("unexpected %q", line)
+		}
+		readyCh <- err
+	}()
+
+	select {
+	case err = <-readyCh:
+	case <-time.After(startTimeout):
+		err = fmt.Errorf("not ready in %v", startTimeout)
+	}
+	if err != nil {
+		_ = p.Kill()
+		_, _ = p.Wait()
+		return nil, fmt.Errorf("new process(pid: %d) failed to start, see logs: %w", p.Pid, err)
+	}
+	return p, nil
+}
+
+// reportUpgraded tells the process which started this one by an upgrade that
+// it is ready, after taking over its pid file if any.
+func reportUpgraded(pidFile string) {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return
+	}
+	_ = os.Unsetenv(upgradeReadyEnv)
+
+	if pidFile != "" {
+		if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			log.Printf("ERROR: write pid file: %v", err)
+		}
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade")
+	defer f.Close()
+	if _, err := f.WriteString("ready\n"); err != nil {
+		log.Printf("ERROR: report upgrade: %v", err)
+	}
+	// the new process is the main one for systemd from now on.
+	sdNotify(fmt.Sprintf("MAINPID=%d", os.Getpid()))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait for a burst of file events to settle
+// before reloading.
+const watchDebounce = 500 * time.Millisecond
+
+// watchConfigFile notifies on the returned channel when the config file at
+// path has changed. The parent directory is watched instead of the file, so
+// that editors replacing the file by rename are followed.
+func watchConfigFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	changedCh := make(chan struct{})
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(watchDebounce)
+		if !timer.Stop() {
+			<-timer.C
+		}
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+					continue
+				}
+				// a fire not received yet would trigger another reload.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(watchDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("ERROR: watch config file: %v", err)
+			case <-timer.C:
+				select {
+				case changedCh <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changedCh, nil
+}
@@ -1,56 +1,707 @@
 package sshtunnel
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"os/exec"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/go-yaml/yaml"
+	"gopkg.in/yaml.v3"
 )
 
 type YAMLConfig struct {
-	KeyFiles []KeyFile `yaml:"key_files"`
-	Gateways []struct {
-		Server       string   `yaml:"server"`
-		ProxyCommand string   `yaml:"proxy_command"`
-		Tunnels      []string `yaml:"tunnels"`
-	} `yaml:"gateways"`
+	KeyFiles []KeyFile       `yaml:"key_files"`
+	Gateways []GatewayConfig `yaml:"gateways"`
+}
+
+type GatewayConfig struct {
+	// Name identifies the gateway to `tunnel up` and `tunnel down`.
+	Name   string `yaml:"name"`
+	Server string `yaml:"server"`
+	// Servers are redundant servers replacing Server, connections go to the
+	// first one available in their order, or in a random order if Failover
+	// is random.
+	Servers      []string `yaml:"servers"`
+	Failover     string   `yaml:"failover"`
+	ProxyCommand string   `yaml:"proxy_command"`
+	// OnDemand defers the ssh connection to the first tunnel connection, and
+	// closes it once it has had no channels for IdleTimeout.
+	OnDemand    bool          `yaml:"on_demand"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ConnectOnStart establishes the ssh connection when the gateway is
+	// started, instead of on the first tunnel connection.
+	ConnectOnStart bool `yaml:"connect_on_start"`
+	// MaxChannels limits the channels open at once through the ssh
+	// connection, dialing more fails. 0 is unlimited.
+	MaxChannels int `yaml:"max_channels"`
+	// Pool is the number of ssh connections to the gateway, 1 by default.
+	// Channels are spread across them by PoolPolicy, least_channels by
+	// default or round_robin.
+	Pool       int    `yaml:"pool"`
+	PoolPolicy string `yaml:"pool_policy"`
+	// UploadLimit and DownloadLimit shape the traffic of all tunnels of the
+	// gateway in bytes per second, e.g. 512K or 10MB.
+	UploadLimit   string         `yaml:"upload_limit"`
+	DownloadLimit string         `yaml:"download_limit"`
+	Tunnels       []TunnelConfig `yaml:"tunnels"`
+}
+
+// ServerList returns the servers of the gateway, either Servers or Server.
+func (c GatewayConfig) ServerList() []string {
+	if len(c.Servers) > 0 {
+		return c.Servers
+	}
+	return []string{c.Server}
+}
+
+func (c GatewayConfig) String() string {
+	return strings.Join(c.ServerList(), ",")
+}
+
+// DefaultIdleTimeout is the idle timeout of on-demand gateways without
+// idle_timeout.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// OnDemandIdleTimeout returns the idle timeout of an on-demand gateway, or 0
+// if the gateway is not on demand.
+func (c GatewayConfig) OnDemandIdleTimeout() time.Duration {
+	if !c.OnDemand {
+		return 0
+	}
+	if c.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+// Bandwidth returns the upload and download limits of the gateway in bytes
+// per second, 0 is unlimited.
+func (c GatewayConfig) Bandwidth() (upload, download int64, err error) {
+	return parseBandwidth(c.UploadLimit, c.DownloadLimit)
+}
+
+// TunnelConfig is a tunnel entry of a gateway, written either in the
+// shorthand form `remoteAddr:port -> 127.0.0.1:port` or as a mapping.
+type TunnelConfig struct {
+	Name   string `yaml:"name"`
+	Remote string `yaml:"remote"`
+	// Remotes are several remote addresses replacing Remote, connections
+	// are balanced across them by Balance, round_robin by default or
+	// least_connections.
+	Remotes []string `yaml:"remotes"`
+	Balance string   `yaml:"balance"`
+	Local   string   `yaml:"local"`
+	// Type is the network of the local address, tcp or unix. It is detected
+	// from the local address if empty.
+	Type    string `yaml:"type"`
+	Enabled *bool  `yaml:"enabled"`
+
+	// Allow and Deny are CIDRs or IPs of the clients of a tcp tunnel, Deny
+	// takes precedence and any client is allowed if Allow is empty.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// AllowUIDs and AllowGIDs restrict the clients of a unix socket tunnel
+	// by their peer credentials, matching either is enough.
+	AllowUIDs []int `yaml:"allow_uids"`
+	AllowGIDs []int `yaml:"allow_gids"`
+	// Mode, Owner and Group are applied to the unix socket file, owner and
+	// group are names or numeric ids.
+	Mode  string `yaml:"mode"`
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+
+	// TLS terminates tls on the local side, RemoteTLS originates tls
+	// towards the remote address.
+	TLS       *TLSConfig       `yaml:"tls"`
+	RemoteTLS *RemoteTLSConfig `yaml:"remote_tls"`
+
+	// ProxyProtocol writes a PROXY protocol header, v1 or v2, with the
+	// address of the client to the remote address. AcceptProxyProtocol reads
+	// and strips such a header from local clients, e.g. behind a local load
+	// balancer, and passes on the client address in it.
+	ProxyProtocol       string `yaml:"proxy_protocol"`
+	AcceptProxyProtocol bool   `yaml:"accept_proxy_protocol"`
+
+	// MaxConnections limits the connections forwarded at once, further
+	// ones are rejected or, with QueueConnections, left waiting to be
+	// accepted until one finishes. 0 is unlimited.
+	MaxConnections   int  `yaml:"max_connections"`
+	QueueConnections bool `yaml:"queue_connections"`
+	// ConnRate limits new connections per second with bursts of up to
+	// ConnBurst, connections beyond it are rejected. 0 is unlimited.
+	ConnRate  float64 `yaml:"conn_rate"`
+	ConnBurst int     `yaml:"conn_burst"`
+
+	// UploadLimit and DownloadLimit shape the traffic to and from the
+	// remote address in bytes per second, e.g. 512K or 10MB, within the
+	// limits of the gateway.
+	UploadLimit   string `yaml:"upload_limit"`
+	DownloadLimit string `yaml:"download_limit"`
+
+	// IdleTimeout closes connections which have transferred nothing in
+	// either direction for that long, MaxLifetime closes connections that
+	// long after they have been accepted. 0 disables them.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+
+	// HealthCheck periodically checks the remote addresses through the
+	// gateway.
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+
+	// shorthand is the tunnel as written in the shorthand form, kept to
+	// report format errors on validation.
+	shorthand string
+}
+
+// ParseTunnelConfig parses the shorthand form of a tunnel.
+func ParseTunnelConfig(tunnelStr string) (TunnelConfig, error) {
+	dialAddr, bindAddr, err := parseTunnel(tunnelStr)
+	if err != nil {
+		return TunnelConfig{}, err
+	}
+	return TunnelConfig{Remote: dialAddr, Local: bindAddr}, nil
+}
+
+func (c *TunnelConfig) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		*c = TunnelConfig{shorthand: value.Value}
+		c.Remote, c.Local, _ = splitTunnel(value.Value)
+	case yaml.MappingNode:
+		if err := checkKnownFields(value, c); err != nil {
+			return err
+		}
+		type plain TunnelConfig
+		return value.Decode((*plain)(c))
+	default:
+		return ValidationError{Line: value.Line, Message: "tunnel must be a string or a mapping"}
+	}
+	return nil
+}
+
+// Bandwidth returns the upload and download limits of the tunnel in bytes
+// per second, 0 is unlimited.
+func (c TunnelConfig) Bandwidth() (upload, download int64, err error) {
+	return parseBandwidth(c.UploadLimit, c.DownloadLimit)
+}
+
+func parseBandwidth(uploadLimit, downloadLimit string) (upload, download int64, err error) {
+	if upload, err = parseByteRate(uploadLimit); err != nil {
+		return 0, 0, fmt.Errorf("invalid upload_limit %s: %w", uploadLimit, err)
+	}
+	if download, err = parseByteRate(downloadLimit); err != nil {
+		return 0, 0, fmt.Errorf("invalid download_limit %s: %w", downloadLimit, err)
+	}
+	return upload, download, nil
+}
+
+var byteRateRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMG]?)(?:I?B)?(?:/S)?$`)
+
+// parseByteRate parses bytes per second such as 512K, 1.5MB or 10MiB/s,
+// units are powers of 1024. Empty is 0, i.e. unlimited.
+func parseByteRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m := byteRateRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, errors.New("not a byte rate (e.g. 512K or 10MB)")
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := m[2]
+	if unit == "" {
+		unit = "B"
+	}
+	n *= float64(int64(1) << (10 * strings.Index("BKMG", unit)))
+	if n < 1 {
+		return 0, errors.New("less than 1 byte per second")
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which overflows int64.
+	if n >= math.MaxInt64 {
+		return 0, errors.New("too large")
+	}
+	return int64(n), nil
+}
+
+// RemoteList returns the remote addresses of the tunnel, either Remotes or
+// Remote.
+func (c TunnelConfig) RemoteList() []string {
+	if len(c.Remotes) > 0 {
+		return c.Remotes
+	}
+	return []string{c.Remote}
+}
+
+// IsEnabled reports whether the tunnel should be started, tunnels are
+// enabled unless disabled explicitly.
+func (c TunnelConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c TunnelConfig) String() string {
+	if c.Remote == "" && c.Local == "" && c.shorthand != "" {
+		return c.shorthand
+	}
+	return strings.Join(c.RemoteList(), ",") + " -> " + c.Local
+}
+
+func (c TunnelConfig) validate() error {
+	if c.shorthand != "" {
+		if _, _, err := splitTunnel(c.shorthand); err != nil {
+			return err
+		}
+	}
+	if len(c.Remotes) > 0 && c.Remote != "" {
+		return errors.New("remote and remotes are exclusive")
+	}
+	for _, remote := range c.RemoteList() {
+		if err := checkTunnelAddrs(remote, c.Local); err != nil {
+			return err
+		}
+	}
+	switch c.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConnections:
+	default:
+		return fmt.Errorf("invalid balance %s (%s or %s)", c.Balance, BalanceRoundRobin, BalanceLeastConnections)
+	}
+	switch c.Type {
+	case "":
+	case "tcp":
+		if err := checkHostPort(c.Local); err != nil {
+			return fmt.Errorf("invalid tcp bind address %s: %w", c.Local, err)
+		}
+	case "unix":
+	default:
+		return fmt.Errorf("invalid type %s (tcp or unix)", c.Type)
+	}
+
+	if _, err := newAccessPolicy(c); err != nil {
+		return err
+	}
+	if _, err := newSocketPerm(c); err != nil {
+		return err
+	}
+	if c.TLS != nil {
+		if _, err := c.TLS.serverConfig(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	if c.RemoteTLS != nil {
+		for _, remote := range c.RemoteList() {
+			if _, err := c.RemoteTLS.clientConfig(remote); err != nil {
+				return fmt.Errorf("remote tls: %w", err)
+			}
+		}
+	}
+	if err := checkProxyProtocol(c.ProxyProtocol); err != nil {
+		return err
+	}
+	if c.HealthCheck != nil {
+		if err := c.HealthCheck.validate(); err != nil {
+			return fmt.Errorf("health check: %w", err)
+		}
+	}
+	if _, _, err := c.Bandwidth(); err != nil {
+		return err
+	}
+	switch {
+	case c.MaxConnections < 0:
+		return errors.New("negative max_connections")
+	case c.QueueConnections && c.MaxConnections == 0:
+		return errors.New("queue_connections requires max_connections")
+	case c.ConnRate < 0 || c.ConnBurst < 0:
+		return errors.New("negative conn_rate or conn_burst")
+	case c.ConnBurst > 0 && c.ConnRate == 0:
+		return errors.New("conn_burst requires conn_rate")
+	case c.IdleTimeout < 0 || c.MaxLifetime < 0:
+		return errors.New("negative idle_timeout or max_lifetime")
+	}
+	unix := bindNetwork(c.Type, c.Local) == "unix"
+	switch {
+	case unix && (len(c.Allow) > 0 || len(c.Deny) > 0):
+		return errors.New("allow and deny only apply to tcp tunnels, use allow_uids and allow_gids")
+	case !unix && (len(c.AllowUIDs) > 0 || len(c.AllowGIDs) > 0):
+		return errors.New("allow_uids and allow_gids only apply to unix socket tunnels")
+	case !unix && (c.Mode != "" || c.Owner != "" || c.Group != ""):
+		return errors.New("mode, owner and group only apply to unix socket tunnels")
+	}
+	return nil
 }
 
 func (c *YAMLConfig) Equals(r *YAMLConfig) bool {
 	return reflect.DeepEqual(c, r)
 }
 
-type KeyFile struct {
-	Path       string
-	Passphrase string
+// Validate checks gateway and tunnel formats, duplicate bind addresses and
+// names, key file readability and proxy commands, and reports all errors
+// found.
+func (c *YAMLConfig) Validate() error {
+	return c.validate(nil)
 }
 
-func (f *KeyFile) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var raw interface{}
-	if err := unmarshal(&raw); err != nil {
+func (c *YAMLConfig) validate(doc *yaml.Node) error {
+	var errs ValidationErrors
+	add := func(path []interface{}, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{
+			Line:    lineOf(doc, path...),
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for i, kf := range c.KeyFiles {
+		if kf.Path == "" {
+			add([]interface{}{"key_files", i}, "key file without path")
+			continue
+		}
+		if _, err := readKeyFile(kf.Path); err != nil {
+			add([]interface{}{"key_files", i}, "key file %s: %v", kf.Path, err)
+		}
+	}
+
+	bindAddrs := make(map[string]string)
+	// gateways and tunnels share names, so that a name refers to one of them.
+	names := make(map[string]string)
+	checkName := func(path []interface{}, name, what string) {
+		if name == "" {
+			return
+		}
+		if prev, ok := names[name]; ok {
+			add(path, "%s: name %s already used by %s", what, name, prev)
+			return
+		}
+		names[name] = what
+	}
+	for i, g := range c.Gateways {
+		checkName([]interface{}{"gateways", i, "name"}, g.Name, "gateway "+g.String())
+		switch {
+		case len(g.Servers) == 0:
+			if _, _, err := parseGateway(g.Server); err != nil {
+				add([]interface{}{"gateways", i, "server"}, "gateway %q: %v", g.Server, err)
+			}
+		case g.Server != "":
+			add([]interface{}{"gateways", i, "servers"}, "gateway %s can not have both server and servers", g.Server)
+		default:
+			for j, server := range g.Servers {
+				if _, _, err := parseGateway(server); err != nil {
+					add([]interface{}{"gateways", i, "servers", j}, "gateway %q: %v", server, err)
+				}
+			}
+		}
+		switch g.Failover {
+		case "", FailoverOrdered, FailoverRandom:
+			if g.Failover != "" && len(g.Servers) == 0 {
+				add([]interface{}{"gateways", i, "failover"}, "failover of gateway %s requires servers", g.String())
+			}
+		default:
+			add([]interface{}{"gateways", i, "failover"}, "invalid failover %s of gateway %s (%s or %s)", g.Failover, g.String(), FailoverOrdered, FailoverRandom)
+		}
+		switch {
+		case g.IdleTimeout < 0:
+			add([]interface{}{"gateways", i, "idle_timeout"}, "negative idle timeout of gateway %s", g.String())
+		case g.IdleTimeout > 0 && !g.OnDemand:
+			add([]interface{}{"gateways", i, "idle_timeout"}, "idle timeout of gateway %s requires on_demand", g.String())
+		}
+		if _, err := parseByteRate(g.UploadLimit); err != nil {
+			add([]interface{}{"gateways", i, "upload_limit"}, "gateway %s: invalid upload_limit %s: %v", g.String(), g.UploadLimit, err)
+		}
+		if _, err := parseByteRate(g.DownloadLimit); err != nil {
+			add([]interface{}{"gateways", i, "download_limit"}, "gateway %s: invalid download_limit %s: %v", g.String(), g.DownloadLimit, err)
+		}
+		if g.Pool < 0 {
+			add([]interface{}{"gateways", i, "pool"}, "negative pool of gateway %s", g.String())
+		}
+		switch g.PoolPolicy {
+		case "", PoolLeastChannels, PoolRoundRobin:
+		default:
+			add([]interface{}{"gateways", i, "pool_policy"}, "invalid pool policy %s of gateway %s (%s or %s)", g.PoolPolicy, g.String(), PoolLeastChannels, PoolRoundRobin)
+		}
+		if g.MaxChannels < 0 {
+			add([]interface{}{"gateways", i, "max_channels"}, "negative max channels of gateway %s", g.String())
+		}
+		if g.OnDemand && g.ConnectOnStart {
+			add([]interface{}{"gateways", i, "connect_on_start"}, "gateway %s can not be both on_demand and connect_on_start", g.String())
+		}
+		if g.ProxyCommand != "" {
+			if err := checkProxyCommand(g.ProxyCommand); err != nil {
+				add([]interface{}{"gateways", i, "proxy_command"}, "proxy command of gateway %s: %v", g.String(), err)
+			}
+		}
+		for j, t := range g.Tunnels {
+			path := []interface{}{"gateways", i, "tunnels", j}
+			if err := t.validate(); err != nil {
+				add(path, "tunnel %q: %v", t.String(), err)
+				continue
+			}
+			// probes dial through the gateway, which would keep an on_demand
+			// gateway connected.
+			if t.HealthCheck != nil && g.OnDemand {
+				add(append(path, "health_check"), "tunnel %q: health check requires a gateway which is not on_demand", t.String())
+			}
+			checkName(append(path, "name"), t.Name, fmt.Sprintf("tunnel %q", t.String()))
+			if prev, ok := bindAddrs[t.Local]; ok {
+				add(path, "tunnel %q: bind address %s already used by %q", t.String(), t.Local, prev)
+				continue
+			}
+			bindAddrs[t.Local] = t.String()
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkKnownFields reports keys of the mapping node which are not fields of
+// the struct v points to, nested structs are checked recursively. Decoding a
+// node does not report unknown fields by itself, even when the document is
+// decoded strictly.
+func checkKnownFields(node *yaml.Node, v interface{}) error {
+	return checkStructFields(node, reflect.TypeOf(v).Elem())
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+func checkKnownFieldsOf(node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		// checked by its own UnmarshalYAML
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for _, n := range node.Content {
+			if err := checkKnownFieldsOf(n, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return checkStructFields(node, t)
+	}
+	return nil
+}
+
+func checkStructFields(node *yaml.Node, t reflect.Type) error {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		ft, ok := fields[k.Value]
+		if !ok {
+			return ValidationError{Line: k.Line, Message: fmt.Sprintf("field %s not found in type %s", k.Value, t)}
+		}
+		if err := checkKnownFieldsOf(v, ft); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proxyCommandShell runs proxy commands, see proxyDialer.
+const proxyCommandShell = "bash"
+
+// shellWords are the builtins and keywords a proxy command can start with
+// instead of a program, e.g. exec nc %h %p.
+var shellWords = map[string]bool{
+	"exec": true, "command": true, "builtin": true, "eval": true, "source": true, ".": true,
+	"if": true, "for": true, "while": true, "until": true, "case": true, "time": true,
+	"{": true, "(": true, "!": true, "[[": true,
+}
+
+// checkProxyCommand checks the shell running proxy commands and the program
+// of command can be found. Commands starting with a builtin, a keyword or a
+// variable assignment are left to the shell.
+func checkProxyCommand(command string) error {
+	if _, err := exec.LookPath(proxyCommandShell); err != nil {
+		return err
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return errors.New("empty command")
+	}
+	if shellWords[fields[0]] || strings.Contains(fields[0], "=") {
+		return nil
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
 		return err
 	}
+	return nil
+}
 
-	switch raw := raw.(type) {
-	case string:
-		*f = KeyFile{
-			Path: raw,
+// ValidationError is an error in a config file, Line is 0 if unknown.
+type ValidationError struct {
+	Line    int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ValidationErrors are all errors found in a config file.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// lineOf returns the line of the node at path in doc, keys of mappings are
+// given as strings and indexes of sequences as ints. The line of the closest
+// existing parent is returned if the path can not be found fully.
+func lineOf(doc *yaml.Node, path ...interface{}) int {
+	if doc == nil {
+		return 0
+	}
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				return line
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == p {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case int:
+			if node.Kind != yaml.SequenceNode || p >= len(node.Content) {
+				return line
+			}
+			next = node.Content[p]
+		}
+		if next == nil {
+			return line
 		}
-	case map[interface{}]interface{}:
-		path, _ := raw["path"].(string)
-		passphrase, _ := raw["passphrase"].(string)
+		node, line = next, next.Line
+	}
+	return line
+}
+
+type KeyFile struct {
+	Path       string
+	Passphrase string
+}
+
+func (f *KeyFile) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
 		*f = KeyFile{
-			Path:       path,
-			Passphrase: passphrase,
+			Path: value.Value,
 		}
+	case yaml.MappingNode:
+		*f = KeyFile{}
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			k, v := value.Content[i], value.Content[i+1]
+			if v.Kind != yaml.ScalarNode {
+				return ValidationError{Line: v.Line, Message: fmt.Sprintf("key file %s must be a string", k.Value)}
+			}
+			switch k.Value {
+			case "path":
+				f.Path = v.Value
+			case "passphrase":
+				f.Passphrase = v.Value
+			default:
+				return ValidationError{Line: k.Line, Message: fmt.Sprintf("field %s not found in key file", k.Value)}
+			}
+		}
+	default:
+		return ValidationError{Line: value.Line, Message: "key file must be a path or a mapping of path and passphrase"}
 	}
 	return nil
 }
 
+// LoadConfigFile decodes and validates a yaml config. Unknown fields are
+// reported as errors, so typos do not silently disable settings.
 func LoadConfigFile(r io.Reader) (*YAMLConfig, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, decodeError(err)
+	}
+
 	var config YAMLConfig
-	if err := yaml.NewDecoder(r).Decode(&config); err != nil {
+	if len(doc.Content) > 0 {
+		root := doc.Content[0]
+		if err := checkKnownFields(root, &config); err != nil {
+			return nil, decodeError(err)
+		}
+		if err := root.Decode(&config); err != nil {
+			return nil, decodeError(err)
+		}
+	}
+	if err := config.validate(&doc); err != nil {
 		return nil, err
 	}
 	return &config, nil
 }
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// decodeError turns errors of the yaml decoder into ValidationErrors with
+// line numbers where possible.
+func decodeError(err error) error {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	var validationErr ValidationError
+	switch {
+	case errors.As(err, &typeErr):
+		msgs = typeErr.Errors
+	case errors.As(err, &validationErr):
+		return ValidationErrors{validationErr}
+	default:
+		msgs = []string{err.Error()}
+	}
+
+	var errs ValidationErrors
+	for _, msg := range msgs {
+		m := yamlErrorLine.FindStringSubmatch(msg)
+		if m == nil {
+			return err
+		}
+		line, _ := strconv.Atoi(m[1])
+		errs = append(errs, ValidationError{Line: line, Message: m[2]})
+	}
+	return errs
+}
@@ -0,0 +1,338 @@
+package sshtunnel
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	keyFile, err := os.CreateTemp("", "key")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer os.Remove(keyFile.Name())
+
+	config, err := LoadConfigFile(strings.NewReader(`
+key_files:
+  - ` + keyFile.Name() + `
+  - path: ` + keyFile.Name() + `
+    passphrase: secret
+gateways:
+  - server: user@addr:22
+    tunnels:
+      - remoteAddr:80 -> 127.0.0.1:8080
+      - remoteAddr:3306 -> /tmp/mysql.sock
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+	if got := config.KeyFiles[1]; got.Path != keyFile.Name() || got.Passphrase != "secret" {
+		t.Fatalf("got key file %+v", got)
+	}
+	if got := config.Gateways[0].Tunnels; len(got) != 2 {
+		t.Fatalf("got tunnels %v", got)
+	}
+}
+
+func TestLoadConfigFileValidationErrors(t *testing.T) {
+	_, err := LoadConfigFile(strings.NewReader(`
+key_files:
+  - /nonexistent/key
+gateways:
+  - server: addr:22
+    proxy_command: nonexistent-proxy-command %h %p
+    tunnels:
+      - remoteAddr:80 -> 127.0.0.1:8080
+      - remoteAddr:80 127.0.0.1:8081
+      - remoteAddr:81 -> 127.0.0.1:8080
+      - remoteAddr:http -> 127.0.0.1:8082
+  - name: db
+    server: user@addr2:22
+    tunnels:
+      - name: db
+        remote: remoteAddr:5432
+        local: 127.0.0.1:5432
+`))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want ValidationErrors", err)
+	}
+
+	// the named port is valid.
+	wantLines := []int{3, 5, 6, 9, 10, 15}
+	if len(errs) != len(wantLines) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(wantLines), err)
+	}
+	for i, line := range wantLines {
+		if errs[i].Line != line {
+			t.Errorf("error %d: got line %d, want %d: %v", i, errs[i].Line, line, errs[i])
+		}
+	}
+}
+
+func TestLoadConfigFileShellProxyCommand(t *testing.T) {
+	config, err := LoadConfigFile(strings.NewReader(`
+gateways:
+  - server: user@addr:22
+    proxy_command: exec nc %h %p
+    tunnels:
+      - remoteAddr:https -> 127.0.0.1:http
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+	tunnel, err := NewTunnelFromConfig(&Gateway{}, config.Gateways[0].Tunnels[0])
+	if err != nil {
+		t.Fatalf("NewTunnelFromConfig: %v", err)
+	}
+	if tunnel.dialAddr != "remoteAddr:443" {
+		t.Errorf("got dial address %s, want the service port resolved", tunnel.dialAddr)
+	}
+}
+
+func TestLoadConfigFileStrict(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantLine int
+		wantErr  string
+	}{
+		{
+			name: "unknown top-level field",
+			config: `
+key_files: []
+gateway:
+  - server: user@addr:22
+`,
+			wantLine: 3,
+			wantErr:  "field gateway not found",
+		},
+		{
+			name: "unknown gateway field",
+			config: `
+gateways:
+  - server: user@addr:22
+    proxycommand: ssh -W %h:%p bastion
+`,
+			wantLine: 4,
+			wantErr:  "field proxycommand not found",
+		},
+		{
+			name: "unknown key file field",
+			config: `
+key_files:
+  - path: /tmp/key
+    pass: secret
+`,
+			wantLine: 4,
+			wantErr:  "field pass not found in key file",
+		},
+		{
+			name: "invalid key file type",
+			config: `
+key_files:
+  - [/tmp/key]
+`,
+			wantLine: 3,
+			wantErr:  "key file must be a path or a mapping",
+		},
+		{
+			name: "server and servers",
+			config: `
+gateways:
+  - server: user@addr:22
+    servers: [user@addr1:22, user@addr2:22]
+`,
+			wantLine: 4,
+			wantErr:  "both server and servers",
+		},
+		{
+			name: "invalid failover server",
+			config: `
+gateways:
+  - servers:
+      - user@addr1:22
+      - addr2:22
+    failover: random
+`,
+			wantLine: 5,
+			wantErr:  "invalid gateway format",
+		},
+		{
+			name: "invalid health check",
+			config: `
+gateways:
+  - server: user@addr:22
+    tunnels:
+      - remote: db:6379
+        local: 127.0.0.1:6379
+        health_check:
+          type: send_expect
+          send: PING
+`,
+			wantLine: 5,
+			wantErr:  "health check: send_expect health check requires expect",
+		},
+		{
+			name: "remote tls cert without key",
+			config: `
+gateways:
+  - server: user@addr:22
+    tunnels:
+      - remote: api:443
+        local: 127.0.0.1:8443
+        remote_tls:
+          cert: /etc/hostname
+`,
+			wantLine: 5,
+			wantErr:  "remote tls: cert and key must be given together",
+		},
+		{
+			name: "tls key without cert",
+			config: `
+gateways:
+  - server: user@addr:22
+    tunnels:
+      - remote: api:80
+        local: 127.0.0.1:8443
+        tls:
+          key: /etc/hostname
+`,
+			wantLine: 5,
+			wantErr:  "tls: tls requires cert and key",
+		},
+		{
+			name: "invalid gateway download limit",
+			config: `
+gateways:
+  - server: user@addr:22
+    upload_limit: 1M
+    download_limit: 99999999999G
+`,
+			wantLine: 5,
+			wantErr:  "invalid download_limit 99999999999G: too large",
+		},
+		{
+			name: "health check on demand",
+			config: `
+gateways:
+  - server: user@addr:22
+    on_demand: true
+    tunnels:
+      - remote: db:6379
+        local: 127.0.0.1:6379
+        health_check:
+          type: tcp
+`,
+			wantLine: 9,
+			wantErr:  "health check requires a gateway which is not on_demand",
+		},
+		{
+			name: "missing proxy command program",
+			config: `
+gateways:
+  - server: user@addr:22
+    proxy_command: nonexistent-proxy-command %h %p
+`,
+			wantLine: 4,
+			wantErr:  `"nonexistent-proxy-command": executable file not found`,
+		},
+		{
+			name: "syntax error",
+			config: `
+gateways:
+  - server: user@addr:22
+   tunnels: []
+`,
+			wantLine: 2,
+			wantErr:  "did not find expected '-' indicator",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFile(strings.NewReader(tt.config))
+			var errs ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("got %v, want ValidationErrors", err)
+			}
+			if errs[0].Line != tt.wantLine {
+				t.Errorf("got line %d, want %d: %v", errs[0].Line, tt.wantLine, err)
+			}
+			if !strings.Contains(errs[0].Message, tt.wantErr) {
+				t.Errorf("got %q, want it to contain %q", errs[0].Message, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileTunnelForms(t *testing.T) {
+	config, err := LoadConfigFile(strings.NewReader(`
+gateways:
+  - server: user@addr:22
+    tunnels:
+      - remoteAddr:80 -> 127.0.0.1:8080
+      - name: mysql
+        remote: remoteAddr:3306
+        local: /tmp/mysql.sock
+        type: unix
+        enabled: false
+`))
+	if err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+
+	tunnels := config.Gateways[0].Tunnels
+	if got, want := tunnels[0].String(), "remoteAddr:80 -> 127.0.0.1:8080"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !tunnels[0].IsEnabled() {
+		t.Errorf("got shorthand tunnel disabled")
+	}
+	if got := tunnels[1]; got.Name != "mysql" || got.Remote != "remoteAddr:3306" || got.Local != "/tmp/mysql.sock" || got.Type != "unix" {
+		t.Errorf("got %+v", got)
+	}
+	if tunnels[1].IsEnabled() {
+		t.Errorf("got disabled tunnel enabled")
+	}
+
+	_, err = LoadConfigFile(strings.NewReader(`
+gateways:
+  - server: user@addr:22
+    tunnels:
+      - remote: remoteAddr:80
+        locl: 127.0.0.1:8080
+`))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || errs[0].Line != 6 {
+		t.Fatalf("got %v, want unknown field error on line 6", err)
+	}
+}
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"100", 100, false},
+		{"512K", 512 * 1024, false},
+		{"1.5MB", 1536 * 1024, false},
+		{"10MiB/s", 10 << 20, false},
+		{"1g", 1 << 30, false},
+		{"fast", 0, true},
+		{"10T", 0, true},
+		{"0", 0, true},
+		{"8589934591G", 8589934591 << 30, false},
+		{"8589934592G", 0, true},
+		{"99999999999G", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteRate(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%q: got %d, %v, want %d (error %t)", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -43,9 +46,12 @@ type dialer interface {
 	Close() error
 }
 
+// newDialer returns a dialer of the gateway servers, user@addr:port, which
+// are tried by the failover policy if there are several.
 func newDialer(
 	keyFiles []KeyFile,
-	gatewayStr string, // user@addr:port
+	gatewayStrs []string,
+	failover string,
 	gatewayProxyCommand string,
 ) (dialer, error) {
 	auth, cleanup, err := parseKeyFiles(keyFiles)
@@ -53,25 +59,54 @@ func newDialer(
 		cleanup()
 		return nil, fmt.Errorf("parse key files: %w", err)
 	}
-	gatewayInfo := strings.Split(gatewayStr, "@")
-	if len(gatewayInfo) != 2 {
-		cleanup()
-		return nil, errors.New("invalid gateway format (e.g. user@addr:port)")
+
+	var dialers []dialer
+	for _, gatewayStr := range gatewayStrs {
+		gatewayUser, gatewayHost, err := parseGateway(gatewayStr)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		config := &ssh.ClientConfig{
+			User:            gatewayUser,
+			Auth:            auth,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         2 * time.Second,
+		}
+		if len(gatewayStrs) > 1 {
+			// the key files are shared and cleaned up by the failover dialer.
+			if gatewayProxyCommand == "" {
+				dialers = append(dialers, newTCPDialer(gatewayHost, config, func() {}))
+			} else {
+				dialers = append(dialers, newProxyDialer(gatewayHost, config, func() {}, gatewayProxyCommand))
+			}
+			continue
+		}
+		if gatewayProxyCommand == "" {
+			return newTCPDialer(gatewayHost, config, cleanup), nil
+		}
+		return newProxyDialer(gatewayHost, config, cleanup, gatewayProxyCommand), nil
 	}
-	gatewayUser, gatewayHost := gatewayInfo[0], gatewayInfo[1]
-	if _, _, err := net.SplitHostPort(gatewayHost); err != nil {
-		gatewayHost += ":22"
+	return newFailoverDialer(dialers, failover, cleanup), nil
+}
+
+// parseGateway parses user@addr:port into the user and host, the port
+// defaults to 22.
+func parseGateway(gatewayStr string) (user, host string, err error) {
+	gatewayInfo := strings.Split(gatewayStr, "@")
+	if len(gatewayInfo) != 2 || gatewayInfo[0] == "" || gatewayInfo[1] == "" {
+		return "", "", errors.New("invalid gateway format (e.g. user@addr:port)")
 	}
-	config := &ssh.ClientConfig{
-		User:            gatewayUser,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         2 * time.Second,
+	user, host = gatewayInfo[0], gatewayInfo[1]
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += ":22"
 	}
-	if gatewayProxyCommand == "" {
-		return newTCPDialer(gatewayHost, config, cleanup), nil
+	if _, port, err := net.SplitHostPort(host); err != nil {
+		return "", "", fmt.Errorf("invalid gateway address %s: %w", host, err)
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid gateway port %s", port)
 	}
-	return newProxyDialer(gatewayHost, config, cleanup, gatewayProxyCommand), nil
+	return user, host, nil
 }
 
 type tcpDialer struct {
@@ -123,7 +158,7 @@ func newProxyDialer(host string, config *ssh.ClientConfig, configCleanup func(),
 
 func (d *proxyDialer) Dial(ctx context.Context) (*sshClientWrapper, error) {
 	clientConn, proxyConn := net.Pipe()
-	cmd := exec.Command("bash", "-c", d.proxyCommand)
+	cmd := exec.Command(proxyCommandShell, "-c", d.proxyCommand)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	cmd.Stdin = proxyConn
 	cmd.Stdout = proxyConn
@@ -167,3 +202,55 @@ func (d *proxyDialer) Close() error {
 	d.configCleanup()
 	return nil
 }
+
+// failoverDialer dials the servers of a gateway one after another until one
+// of them can be connected to.
+type failoverDialer struct {
+	dialers       []dialer
+	policy        string
+	configCleanup func()
+}
+
+func newFailoverDialer(dialers []dialer, policy string, configCleanup func()) *failoverDialer {
+	if policy == "" {
+		policy = FailoverOrdered
+	}
+	return &failoverDialer{
+		dialers:       dialers,
+		policy:        policy,
+		configCleanup: configCleanup,
+	}
+}
+
+// Dial tries the servers in their order, so that connections fail back to
+// the first ones once they are available again, or in a random order.
+func (d *failoverDialer) Dial(ctx context.Context) (*sshClientWrapper, error) {
+	order := make([]int, len(d.dialers))
+	for i := range order {
+		order[i] = i
+	}
+	if d.policy == FailoverRandom {
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+
+	var errs []string
+	for n, i := range order {
+		client, err := d.dialers[i].Dial(ctx)
+		if err == nil {
+			return client, nil
+		}
+		errs = append(errs, err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+		if n < len(order)-1 {
+			log.Printf("ERROR: %v, trying the next server", err)
+		}
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func (d *failoverDialer) Close() error {
+	d.configCleanup()
+	return nil
+}
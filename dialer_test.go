@@ -0,0 +1,113 @@
+package sshtunnel
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// fakeDialer records its dial in dialed and fails unless ok.
+type fakeDialer struct {
+	i      int
+	ok     bool
+	dialed *[]int
+	onDial func()
+}
+
+func (d *fakeDialer) Dial(ctx context.Context) (*sshClientWrapper, error) {
+	*d.dialed = append(*d.dialed, d.i)
+	if d.onDial != nil {
+		d.onDial()
+	}
+	if !d.ok {
+		return nil, fmt.Errorf("dial %d: refused", d.i)
+	}
+	return &sshClientWrapper{}, nil
+}
+
+func (d *fakeDialer) Close() error {
+	return nil
+}
+
+func newFakeDialers(n int, dialed *[]int) ([]dialer, []*fakeDialer) {
+	var dialers []dialer
+	var fakes []*fakeDialer
+	for i := 0; i < n; i++ {
+		d := &fakeDialer{i: i, dialed: dialed}
+		dialers = append(dialers, d)
+		fakes = append(fakes, d)
+	}
+	return dialers, fakes
+}
+
+func TestFailoverDialerOrdered(t *testing.T) {
+	var dialed []int
+	dialers, fakes := newFakeDialers(3, &dialed)
+	d := newFailoverDialer(dialers, "", func() {})
+
+	fakes[2].ok = true
+	if _, err := d.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if fmt.Sprint(dialed) != "[0 1 2]" {
+		t.Errorf("got dials %v, want [0 1 2]", dialed)
+	}
+
+	// fails back to the first server once it is available again.
+	dialed = nil
+	fakes[0].ok = true
+	if _, err := d.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if fmt.Sprint(dialed) != "[0]" {
+		t.Errorf("got dials %v, want [0]", dialed)
+	}
+
+	dialed = nil
+	fakes[0].ok, fakes[2].ok = false, false
+	_, err := d.Dial(context.Background())
+	if err == nil || err.Error() != "dial 0: refused; dial 1: refused; dial 2: refused" {
+		t.Errorf("got %v, want the errors of all servers", err)
+	}
+}
+
+func TestFailoverDialerRandom(t *testing.T) {
+	var dialed []int
+	dialers, _ := newFakeDialers(3, &dialed)
+	d := newFailoverDialer(dialers, FailoverRandom, func() {})
+
+	orders := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		dialed = nil
+		if _, err := d.Dial(context.Background()); err == nil {
+			t.Fatalf("got no error, want all servers failed")
+		}
+		seen := make(map[int]bool)
+		for _, i := range dialed {
+			seen[i] = true
+		}
+		if len(dialed) != 3 || len(seen) != 3 {
+			t.Fatalf("got dials %v, want each server once", dialed)
+		}
+		orders[fmt.Sprint(dialed)] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("got the same order %v in all dials, want random orders", orders)
+	}
+}
+
+func TestFailoverDialerCancel(t *testing.T) {
+	var dialed []int
+	dialers, fakes := newFakeDialers(3, &dialed)
+	d := newFailoverDialer(dialers, "", func() {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fakes[0].onDial = cancel
+	fakes[1].ok = true
+	if _, err := d.Dial(ctx); err == nil {
+		t.Errorf("got no error, want the dial stopped")
+	}
+	if fmt.Sprint(dialed) != "[0]" {
+		t.Errorf("got dials %v, want no server dialed after cancel", dialed)
+	}
+}
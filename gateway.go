@@ -6,9 +6,24 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Policies of Gateway.SetPool picking the ssh connection of a channel.
+const (
+	PoolLeastChannels = "least_channels"
+	PoolRoundRobin    = "round_robin"
+)
+
+// Failover policies of gateways with several servers.
+const (
+	FailoverOrdered = "ordered"
+	FailoverRandom  = "random"
 )
 
 func NewGateway(
@@ -16,76 +31,292 @@ func NewGateway(
 	gatewayStr string, // user@addr:port
 	gatewayProxyCommand string,
 ) (*Gateway, error) {
-	d, err := newDialer(keyFiles, gatewayStr, gatewayProxyCommand)
+	d, err := newDialer(keyFiles, []string{gatewayStr}, "", gatewayProxyCommand)
+	if err != nil {
+		return nil, err
+	}
+	return newGateway(d, gatewayStr), nil
+}
+
+// NewGatewayFromConfig creates a gateway connecting to the server of c, or
+// to one of its servers by its failover policy.
+func NewGatewayFromConfig(keyFiles []KeyFile, c GatewayConfig) (*Gateway, error) {
+	d, err := newDialer(keyFiles, c.ServerList(), c.Failover, c.ProxyCommand)
+	if err != nil {
+		return nil, err
+	}
+	g := newGateway(d, c.String())
+	upload, download, err := c.Bandwidth()
 	if err != nil {
+		_ = d.Close()
 		return nil, err
 	}
+	g.SetOnDemand(c.OnDemandIdleTimeout())
+	g.SetMaxChannels(c.MaxChannels)
+	g.SetPool(c.Pool, c.PoolPolicy)
+	g.SetBandwidth(upload, download)
+	return g, nil
+}
 
-	return &Gateway{d: d}, nil
+func newGateway(d dialer, server string) *Gateway {
+	g := &Gateway{
+		d:          d,
+		server:     server,
+		poolPolicy: PoolLeastChannels,
+		upload:     &rateLimiter{},
+		download:   &rateLimiter{},
+	}
+	g.pool = []*poolConn{newPoolConn(g)}
+	return g
 }
 
 type Gateway struct {
-	d   dialer
-	c   *sshClientWrapper
-	mux sync.RWMutex
+	d dialer
+
+	server string
+
+	// pool is the ssh connections of the gateway, Dial picks one of them by
+	// poolPolicy.
+	poolMux    sync.Mutex
+	pool       []*poolConn
+	poolPolicy string
+	nextConn   int
+
+	// idleTimeout makes the gateway on demand: the ssh connections are only
+	// established by Dial and closed once the gateway has had no channels
+	// for that long. 0 keeps the connections open.
+	idleMux     sync.Mutex
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	channels    int64
+
+	// maxChannels limits the channels open at once, 0 is unlimited.
+	maxChannels      int
+	rejectedChannels int64
+
+	// upload and download shape the traffic of all channels.
+	upload   *rateLimiter
+	download *rateLimiter
+
+	statMux sync.RWMutex
+	closed  bool
+	lastErr error
 }
 
+// ErrChannelLimit is returned by Dial when the gateway has as many channels
+// open as it is allowed to.
+var ErrChannelLimit = errors.New("channel limit reached")
+
 func (g *Gateway) Dial(ctx context.Context, n, addr string) (net.Conn, error) {
-	conn, err := g.getC().Dial(n, addr)
+	// count the channel before dialing, so that an idle on-demand
+	// connection is not closed under it.
+	if err := g.addChannel(); err != nil {
+		return nil, err
+	}
+	pc := g.pickConn()
+	conn, err := pc.dial(ctx, n, addr)
 	if err != nil {
-		if errors.Is(err, errSSHClientNotInitialized) {
-			if err := g.connect(ctx); err != nil {
-				return nil, fmt.Errorf("connect: %w", err)
-			}
-		} else {
-			if err := g.reconnect(ctx); err != nil {
-				return nil, fmt.Errorf("reconnect: %w", err)
+		g.releaseChannel(pc)
+		return nil, err
+	}
+	return &channelConn{Conn: conn, done: func() { g.releaseChannel(pc) }}, nil
+}
+
+// SetPool makes the gateway keep size ssh connections, and spread channels
+// across them by policy. Connections beyond a smaller size are closed once
+// their channels are done.
+func (g *Gateway) SetPool(size int, policy string) {
+	if size < 1 {
+		size = 1
+	}
+	if policy == "" {
+		policy = PoolLeastChannels
+	}
+
+	g.poolMux.Lock()
+	var retired []*poolConn
+	if size < len(g.pool) {
+		retired = g.pool[size:]
+		g.pool = g.pool[:size:size]
+	}
+	for len(g.pool) < size {
+		g.pool = append(g.pool, newPoolConn(g))
+	}
+	g.poolPolicy = policy
+	g.poolMux.Unlock()
+
+	for _, pc := range retired {
+		pc.retire()
+	}
+}
+
+// pickConn takes a channel of an ssh connection of the pool, picked by the
+// pool policy.
+func (g *Gateway) pickConn() *poolConn {
+	g.poolMux.Lock()
+	defer g.poolMux.Unlock()
+
+	var pc *poolConn
+	switch g.poolPolicy {
+	case PoolRoundRobin:
+		pc = g.pool[g.nextConn%len(g.pool)]
+		g.nextConn++
+	default:
+		for _, c := range g.pool {
+			if pc == nil || atomic.LoadInt64(&c.channels) < atomic.LoadInt64(&pc.channels) {
+				pc = c
 			}
 		}
+	}
+	atomic.AddInt64(&pc.channels, 1)
+	return pc
+}
 
-		return g.getC().Dial(n, addr)
+func (g *Gateway) releaseChannel(pc *poolConn) {
+	pc.doneChannel()
+	g.doneChannel()
+}
+
+// conns returns the ssh connections of the pool.
+func (g *Gateway) conns() []*poolConn {
+	g.poolMux.Lock()
+	defer g.poolMux.Unlock()
+	return append([]*poolConn(nil), g.pool...)
+}
+
+// SetOnDemand makes the gateway connect on the first Dial only, and close its
+// ssh connections once it has had no channels for idleTimeout. 0 turns it
+// off.
+func (g *Gateway) SetOnDemand(idleTimeout time.Duration) {
+	g.idleMux.Lock()
+	defer g.idleMux.Unlock()
+
+	g.idleTimeout = idleTimeout
+	g.resetIdleTimer()
+}
+
+// SetMaxChannels limits the channels open at once through the gateway,
+// Dial fails with ErrChannelLimit beyond it. 0 is unlimited.
+func (g *Gateway) SetMaxChannels(n int) {
+	g.idleMux.Lock()
+	defer g.idleMux.Unlock()
+	g.maxChannels = n
+}
+
+// SetBandwidth limits the traffic of the tunnels of the gateway to upload
+// and download bytes per second, 0 is unlimited. It applies to connections
+// being forwarded too.
+func (g *Gateway) SetBandwidth(upload, download int64) {
+	g.upload.setRate(float64(upload), 0)
+	g.download.setRate(float64(download), 0)
+}
+
+func (g *Gateway) onDemand() bool {
+	g.idleMux.Lock()
+	defer g.idleMux.Unlock()
+	return g.idleTimeout > 0
+}
+
+func (g *Gateway) getMaxChannels() int {
+	g.idleMux.Lock()
+	defer g.idleMux.Unlock()
+	return g.maxChannels
+}
+
+func (g *Gateway) addChannel() error {
+	g.idleMux.Lock()
+	defer g.idleMux.Unlock()
+
+	if g.maxChannels > 0 && atomic.LoadInt64(&g.channels) >= int64(g.maxChannels) {
+		atomic.AddInt64(&g.rejectedChannels, 1)
+		return fmt.Errorf("%w (%d)", ErrChannelLimit, g.maxChannels)
 	}
+	atomic.AddInt64(&g.channels, 1)
+	g.resetIdleTimer()
+	return nil
+}
 
-	return conn, nil
+func (g *Gateway) doneChannel() {
+	g.idleMux.Lock()
+	defer g.idleMux.Unlock()
+
+	atomic.AddInt64(&g.channels, -1)
+	g.resetIdleTimer()
+}
+
+// resetIdleTimer stops the idle timer, and starts it again if the gateway is
+// on demand and has no channels. It must be called with g.idleMux held.
+func (g *Gateway) resetIdleTimer() {
+	if g.idleTimer != nil {
+		g.idleTimer.Stop()
+		g.idleTimer = nil
+	}
+	if g.idleTimeout > 0 && atomic.LoadInt64(&g.channels) == 0 {
+		g.idleTimer = time.AfterFunc(g.idleTimeout, g.closeIdle)
+	}
+}
+
+// closeIdle closes the ssh connections if the gateway is still on demand and
+// without channels, the next Dial connects again.
+func (g *Gateway) closeIdle() {
+	for _, pc := range g.conns() {
+		pc.closeIf(func() bool {
+			return g.onDemand() && atomic.LoadInt64(&g.channels) == 0
+		}, "close idle gateway")
+	}
 }
 
 func (g *Gateway) Close() error {
-	if g.c != nil {
-		if err := g.c.Close(); err != nil {
-			_ = g.d.Close()
-			return err
+	g.SetOnDemand(0)
+	g.statMux.Lock()
+	g.closed = true
+	g.statMux.Unlock()
+
+	var errs []string
+	for _, pc := range g.conns() {
+		if err := pc.close(); err != nil {
+			errs = append(errs, err.Error())
 		}
 	}
-	return g.d.Close()
+	if err := g.d.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 func (g *Gateway) KeepAlive(ctx context.Context) {
-	var aliveErrCount uint32
-
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for {
-		go func() {
-			if g.getC() == nil {
-				return
-			}
-
-			_, _, err := g.getC().SendRequest("keepalive@openssh.com", true, nil)
-			if err != nil {
-				atomic.StoreUint32(&aliveErrCount, 1)
-			}
-		}()
+		conns := g.conns()
+		for _, pc := range conns {
+			go pc.sendKeepAlive()
+		}
 
 		select {
 		case <-ticker.C:
-			if atomic.LoadUint32(&aliveErrCount) == 1 {
-				log.Printf("ERROR: keep alive of remote(%v), local(%v)", g.getC().RemoteAddr(), g.getC().LocalAddr())
-				if err := g.reconnect(ctx); err != nil {
+			for _, pc := range conns {
+				if !atomic.CompareAndSwapUint32(&pc.aliveErr, 1, 0) {
+					continue
+				}
+				c := pc.getC()
+				if c == nil {
+					// closed while idle
+					continue
+				}
+				log.Printf("ERROR: keep alive of remote(%v), local(%v)", c.RemoteAddr(), c.LocalAddr())
+				if g.onDemand() && atomic.LoadInt64(&g.channels) == 0 {
+					// nothing to keep alive, the next Dial connects again.
+					g.closeIdle()
+					continue
+				}
+				if err := pc.reconnect(ctx); err != nil {
 					log.Printf("ERROR: reconnect: %v", err)
 				}
-
-				atomic.StoreUint32(&aliveErrCount, 0)
 			}
 		case <-ctx.Done():
 			return
@@ -93,29 +324,307 @@ func (g *Gateway) KeepAlive(ctx context.Context) {
 	}
 }
 
-func (g *Gateway) getC() *sshClientWrapper {
-	g.mux.RLock()
-	defer g.mux.RUnlock()
-	return g.c
+// Reconnect drops the current ssh connections if any and dials the gateway
+// again, once per connection of the pool.
+func (g *Gateway) Reconnect(ctx context.Context) error {
+	conns := g.conns()
+	errCh := make(chan error, len(conns))
+	for _, pc := range conns {
+		go func(pc *poolConn) {
+			if pc.getC() == nil {
+				errCh <- pc.connect(ctx)
+			} else {
+				errCh <- pc.reconnect(ctx)
+			}
+		}(pc)
+	}
+
+	var errs []string
+	for range conns {
+		if err := <-errCh; err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Status returns a snapshot of the gateway connection state. The state of a
+// pool is the best one of its connections.
+func (g *Gateway) Status() GatewayStatus {
+	conns := g.conns()
+	g.poolMux.Lock()
+	policy := g.poolPolicy
+	g.poolMux.Unlock()
+
+	s := GatewayStatus{
+		Server:   g.server,
+		State:    GatewayIdle,
+		Channels: atomic.LoadInt64(&g.channels),
+		OnDemand: g.onDemand(),
+
+		MaxChannels:      g.getMaxChannels(),
+		RejectedChannels: atomic.LoadInt64(&g.rejectedChannels),
+	}
+	rank := map[string]int{GatewayIdle: 0, GatewayFailed: 1, GatewayConnecting: 2, GatewayConnected: 3}
+	for _, pc := range conns {
+		ps := pc.status()
+		s.Reconnects += ps.Reconnects
+		if rank[ps.State] > rank[s.State] {
+			s.State = ps.State
+		}
+		if ps.State == GatewayConnected && (s.ConnectedSince.IsZero() || ps.ConnectedSince.Before(s.ConnectedSince)) {
+			s.ConnectedSince, s.RemoteAddr = ps.ConnectedSince, ps.RemoteAddr
+		}
+		if len(conns) > 1 {
+			s.Pool = append(s.Pool, ps)
+		}
+	}
+	if len(conns) > 1 {
+		s.PoolPolicy = policy
+	}
+
+	g.statMux.RLock()
+	defer g.statMux.RUnlock()
+	if g.closed {
+		s.State = GatewayClosed
+	}
+	if g.lastErr != nil {
+		s.LastError = g.lastErr.Error()
+	}
+	return s
+}
+
+func (g *Gateway) setLastErr(err error) {
+	g.statMux.Lock()
+	defer g.statMux.Unlock()
+	g.lastErr = err
+}
+
+// poolConn is one of the ssh connections of a gateway, it is connected and
+// reconnected independently of the others.
+type poolConn struct {
+	g   *Gateway
+	c   *sshClientWrapper
+	mux sync.RWMutex
+
+	channels int64
+	// retired connections have been removed from the pool, they are closed
+	// once their channels are done.
+	retired  int32
+	aliveErr uint32
+
+	statMux        sync.RWMutex
+	state          string
+	connectedSince time.Time
+	remoteAddr     string
+	lastErr        error
+	reconnects     int
+}
+
+func newPoolConn(g *Gateway) *poolConn {
+	return &poolConn{g: g, state: GatewayIdle}
+}
+
+func (pc *poolConn) dial(ctx context.Context, n, addr string) (net.Conn, error) {
+	c := pc.getC()
+	conn, err := c.Dial(n, addr)
+	if err != nil {
+		// the server refused the channel, e.g. as nothing listens on addr,
+		// over a working connection.
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			return nil, err
+		}
+		if err := pc.redial(ctx, c); err != nil {
+			return nil, err
+		}
+
+		return pc.getC().Dial(n, addr)
+	}
+
+	return conn, nil
+}
+
+// redial connects again after a channel could not be opened over c, nil if
+// not connected. Concurrent dials failing over the same connection share the
+// one connected by the first of them.
+func (pc *poolConn) redial(ctx context.Context, c *sshClientWrapper) error {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	if pc.c != nil && pc.c != c {
+		return nil
+	}
+	if pc.c == nil {
+		if err := pc.connectLocked(ctx); err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+		return nil
+	}
+	pc.statMux.Lock()
+	pc.reconnects++
+	pc.statMux.Unlock()
+	if err := pc.connectLocked(ctx); err != nil {
+		return fmt.Errorf("reconnect: %w", err)
+	}
+	return nil
+}
+
+func (pc *poolConn) doneChannel() {
+	if atomic.AddInt64(&pc.channels, -1) == 0 && atomic.LoadInt32(&pc.retired) == 1 {
+		_ = pc.close()
+	}
+}
+
+func (pc *poolConn) retire() {
+	atomic.StoreInt32(&pc.retired, 1)
+	if atomic.LoadInt64(&pc.channels) == 0 {
+		_ = pc.close()
+	}
+}
+
+func (pc *poolConn) sendKeepAlive() {
+	c := pc.getC()
+	if c == nil {
+		return
+	}
+
+	_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+	// ignore errors of a connection closed meanwhile, e.g. when idle.
+	if err != nil && pc.getC() == c {
+		pc.setState(GatewayFailed, fmt.Errorf("keep alive: %w", err))
+		atomic.StoreUint32(&pc.aliveErr, 1)
+	}
+}
+
+func (pc *poolConn) getC() *sshClientWrapper {
+	pc.mux.RLock()
+	defer pc.mux.RUnlock()
+	return pc.c
 }
 
-func (g *Gateway) connect(ctx context.Context) error {
-	g.mux.Lock()
-	defer g.mux.Unlock()
+func (pc *poolConn) connect(ctx context.Context) error {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+	return pc.connectLocked(ctx)
+}
+
+// connectLocked replaces the ssh connection by a new one, it must be called
+// with pc.mux held.
+func (pc *poolConn) connectLocked(ctx context.Context) error {
+	if pc.c != nil {
+		_ = pc.c.Close()
+		pc.c = nil
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	client, err := g.d.Dial(ctx)
+	pc.setState(GatewayConnecting, nil)
+	client, err := pc.g.d.Dial(ctx)
 	if err != nil {
+		pc.setState(GatewayFailed, err)
 		return err
 	}
 
-	g.c = client
+	pc.c = client
+	pc.statMux.Lock()
+	pc.remoteAddr = client.RemoteAddr().String()
+	pc.statMux.Unlock()
+	pc.setState(GatewayConnected, nil)
+
+	// an on-demand gateway connected without channels, e.g. by Reconnect,
+	// is closed again once idle.
+	pc.g.idleMux.Lock()
+	pc.g.resetIdleTimer()
+	pc.g.idleMux.Unlock()
 	return nil
 }
 
-func (g *Gateway) reconnect(ctx context.Context) error {
-	_ = g.c.Close()
-	return g.connect(ctx)
+func (pc *poolConn) reconnect(ctx context.Context) error {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	pc.statMux.Lock()
+	pc.reconnects++
+	pc.statMux.Unlock()
+	return pc.connectLocked(ctx)
+}
+
+// closeIf closes the ssh connection if cond holds, checked with the
+// connection locked.
+func (pc *poolConn) closeIf(cond func() bool, msg string) {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	if pc.c == nil || !cond() {
+		return
+	}
+	log.Printf("%s %s", msg, pc.g.server)
+	_ = pc.c.Close()
+	pc.c = nil
+	pc.setState(GatewayIdle, nil)
+}
+
+func (pc *poolConn) close() error {
+	pc.mux.Lock()
+	defer pc.mux.Unlock()
+
+	if pc.c == nil {
+		return nil
+	}
+	err := pc.c.Close()
+	pc.c = nil
+	pc.setState(GatewayIdle, nil)
+	return err
+}
+
+func (pc *poolConn) status() PoolConnStatus {
+	pc.statMux.RLock()
+	defer pc.statMux.RUnlock()
+
+	s := PoolConnStatus{
+		State:      pc.state,
+		Reconnects: pc.reconnects,
+		Channels:   atomic.LoadInt64(&pc.channels),
+	}
+	if pc.lastErr != nil {
+		s.LastError = pc.lastErr.Error()
+	}
+	if pc.state == GatewayConnected {
+		s.ConnectedSince = pc.connectedSince
+		s.RemoteAddr = pc.remoteAddr
+	}
+	return s
+}
+
+func (pc *poolConn) setState(state string, err error) {
+	pc.statMux.Lock()
+	defer pc.statMux.Unlock()
+
+	if state == GatewayConnected && pc.state != GatewayConnected {
+		pc.connectedSince = time.Now()
+	}
+	pc.state = state
+	if err != nil {
+		pc.lastErr = err
+		pc.g.setLastErr(err)
+	}
+}
+
+// channelConn is a connection dialed through the gateway, it releases its
+// channel count once closed.
+type channelConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *channelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.done)
+	return err
 }
@@ -0,0 +1,168 @@
+package sshtunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGatewayPickConn(t *testing.T) {
+	g := &Gateway{pool: []*poolConn{}}
+	g.SetPool(3, PoolLeastChannels)
+
+	// least channels fills the connections evenly.
+	for i := 0; i < 6; i++ {
+		g.pickConn()
+	}
+	for i, pc := range g.pool {
+		if pc.channels != 2 {
+			t.Errorf("least channels: conn %d got %d channels, want 2", i, pc.channels)
+		}
+	}
+	g.pool[1].doneChannel()
+	if pc := g.pickConn(); pc != g.pool[1] {
+		t.Errorf("least channels: got a conn other than the one with fewer channels")
+	}
+
+	g.SetPool(3, PoolRoundRobin)
+	for i := 0; i < 6; i++ {
+		if pc := g.pickConn(); pc != g.pool[i%3] {
+			t.Errorf("round robin: pick %d got another conn than %d", i, i%3)
+		}
+	}
+
+	retired := g.pool[2]
+	g.SetPool(2, PoolRoundRobin)
+	if len(g.pool) != 2 || retired.retired != 1 {
+		t.Fatalf("shrink: got %d conns, retired %d", len(g.pool), retired.retired)
+	}
+	for i := 0; i < 4; i++ {
+		if pc := g.pickConn(); pc == retired {
+			t.Fatalf("shrink: picked a retired conn")
+		}
+	}
+}
+
+// testDialer connects to an in-process ssh server rejecting all channels,
+// and counts its dials.
+type testDialer struct {
+	l      net.Listener
+	config *ssh.ServerConfig
+	dials  int32
+	// broken makes the server close the connection, once its channels have
+	// been waited for a while, instead of rejecting them.
+	broken int32
+}
+
+func newTestDialer(t *testing.T) *testDialer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	d := &testDialer{l: l, config: config}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *testDialer) serve(conn net.Conn) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, d.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		if atomic.CompareAndSwapInt32(&d.broken, 1, 0) {
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		_ = ch.Reject(ssh.Prohibited, "test")
+	}
+}
+
+func (d *testDialer) Dial(ctx context.Context) (*sshClientWrapper, error) {
+	atomic.AddInt32(&d.dials, 1)
+	client, err := ssh.Dial("tcp", d.l.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sshClientWrapper{Client: client}, nil
+}
+
+func (d *testDialer) Close() error {
+	return nil
+}
+
+func TestPoolConnConcurrentDials(t *testing.T) {
+	d := newTestDialer(t)
+	g := newGateway(d, "test")
+	pc := g.pool[0]
+	defer pc.close()
+
+	dialAll := func() {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				// the server rejects the channel once connected.
+				var openErr *ssh.OpenChannelError
+				if _, err := pc.dial(context.Background(), "tcp", "127.0.0.1:1"); !errors.As(err, &openErr) {
+					t.Errorf("got %v, want the channel rejected", err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+	}
+
+	dialAll()
+	if n := atomic.LoadInt32(&d.dials); n != 1 {
+		t.Errorf("not connected: got %d connections, want 1", n)
+	}
+
+	// all dials fail over the connection broken meanwhile, it is replaced
+	// once.
+	atomic.StoreInt32(&d.broken, 1)
+	dialAll()
+	if n := atomic.LoadInt32(&d.dials); n != 2 {
+		t.Errorf("broken: got %d connections, want 2", n)
+	}
+	if st := pc.status(); st.Reconnects != 1 {
+		t.Errorf("broken: got %d reconnects, want 1", st.Reconnects)
+	}
+}
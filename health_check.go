@@ -0,0 +1,276 @@
+package sshtunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of health checks of the remote addresses of a tunnel.
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckSend = "send_expect"
+)
+
+// Health of a tunnel or one of its remote addresses, empty if unchecked.
+const (
+	Healthy   = "healthy"
+	Unhealthy = "unhealthy"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// maxExpectSize bounds the response read looking for the expected string.
+const maxExpectSize = 64 << 10
+
+// HealthCheckConfig periodically checks the remote addresses of a tunnel
+// through the gateway.
+type HealthCheckConfig struct {
+	// Type is tcp to open a connection, http to GET Path expecting a 2xx
+	// or 3xx status, or send_expect to write Send and read until Expect.
+	Type   string `yaml:"type"`
+	Path   string `yaml:"path"`
+	Send   string `yaml:"send"`
+	Expect string `yaml:"expect"`
+	// Interval defaults to 10s, Timeout to 5s.
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Failures is the number of consecutive failed checks after which an
+	// address is unhealthy, 1 by default.
+	Failures int `yaml:"failures"`
+	// CloseListener stops listening while all remote addresses are
+	// unhealthy, so that clients fail fast instead of connecting to a dead
+	// target.
+	CloseListener bool `yaml:"close_listener"`
+}
+
+func (c *HealthCheckConfig) validate() error {
+	switch c.Type {
+	case HealthCheckTCP:
+		if c.Path != "" || c.Send != "" || c.Expect != "" {
+			return errors.New("path, send and expect do not apply to tcp health checks")
+		}
+	case HealthCheckHTTP:
+		if c.Path != "" && c.Path[0] != '/' {
+			return fmt.Errorf("invalid path %s (e.g. /healthz)", c.Path)
+		}
+		if c.Send != "" || c.Expect != "" {
+			return errors.New("send and expect do not apply to http health checks")
+		}
+	case HealthCheckSend:
+		if c.Expect == "" {
+			return errors.New("send_expect health check requires expect")
+		}
+		if c.Path != "" {
+			return errors.New("path only applies to http health checks")
+		}
+	default:
+		return fmt.Errorf("invalid type %s (%s, %s or %s)", c.Type, HealthCheckTCP, HealthCheckHTTP, HealthCheckSend)
+	}
+	switch {
+	case c.Interval < 0 || c.Timeout < 0:
+		return errors.New("negative interval or timeout")
+	case c.Failures < 0:
+		return errors.New("negative failures")
+	}
+	return nil
+}
+
+func (c *HealthCheckConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return defaultHealthCheckInterval
+	}
+	return c.Interval
+}
+
+func (c *HealthCheckConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultHealthCheckTimeout
+	}
+	return c.Timeout
+}
+
+func (c *HealthCheckConfig) failures() int {
+	if c.Failures == 0 {
+		return 1
+	}
+	return c.Failures
+}
+
+// check runs the health check on conn, connected to addr. tlsConfig
+// originates tls first if set.
+func (c *HealthCheckConfig) check(conn net.Conn, addr string, tlsConfig *tls.Config) error {
+	// ssh channels do not support deadlines, close the connection instead.
+	timer := time.AfterFunc(c.timeout(), func() { _ = conn.Close() })
+	err := c.exchange(conn, addr, tlsConfig)
+	if !timer.Stop() {
+		return fmt.Errorf("timeout after %v", c.timeout())
+	}
+	return err
+}
+
+func (c *HealthCheckConfig) exchange(conn net.Conn, addr string, tlsConfig *tls.Config) error {
+	if c.Type == HealthCheckTCP {
+		return nil
+	}
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("tls handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	if c.Type == HealthCheckHTTP {
+		path := c.Path
+		if path == "" {
+			path = "/"
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if err != nil {
+			return err
+		}
+		req.Close = true
+		req.Header.Set("User-Agent", "sshtunnel-health-check")
+		if err := req.Write(conn); err != nil {
+			return fmt.Errorf("write request: %w", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return fmt.Errorf("read response: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: %s", path, resp.Status)
+		}
+		return nil
+	}
+
+	if c.Send != "" {
+		if _, err := io.WriteString(conn, c.Send); err != nil {
+			return fmt.Errorf("send: %w", err)
+		}
+	}
+	var got []byte
+	buf := make([]byte, 4096)
+	for len(got) < maxExpectSize {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if bytes.Contains(got, []byte(c.Expect)) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%q not received: %w", c.Expect, err)
+		}
+	}
+	return fmt.Errorf("%q not received in %d bytes", c.Expect, maxExpectSize)
+}
+
+// healthChecker checks the remote addresses of a tunnel, unhealthy ones are
+// dialed last and the tunnel is unhealthy while all of them are.
+type healthChecker struct {
+	config *HealthCheckConfig
+
+	mux     sync.Mutex
+	healthy bool
+	// changed is signaled when the tunnel health changes.
+	changed chan struct{}
+}
+
+func newHealthChecker(config *HealthCheckConfig) *healthChecker {
+	return &healthChecker{config: config, healthy: true, changed: make(chan struct{}, 1)}
+}
+
+func (h *healthChecker) isHealthy() bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.healthy
+}
+
+func (h *healthChecker) setHealthy(healthy bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.healthy == healthy {
+		return
+	}
+	h.healthy = healthy
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// checkHealth checks the remote addresses every interval until ctx is done.
+func (t *tunnel) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(t.health.config.interval())
+	defer ticker.Stop()
+	for {
+		t.checkTargets(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkTargets checks all remote addresses at once and updates the health of
+// the tunnel.
+func (t *tunnel) checkTargets(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, tg := range t.targets.list {
+		wg.Add(1)
+		go func(target *target) {
+			defer wg.Done()
+			err := t.checkTarget(ctx, target.addr)
+			if ctx.Err() != nil || errors.Is(err, ErrChannelLimit) {
+				// not a verdict on the remote address.
+				return
+			}
+			switch t.targets.setHealth(target, err, t.health.config.failures()) {
+			case Healthy:
+				log.Printf("health check %s: healthy", target.addr)
+			case Unhealthy:
+				log.Printf("ERROR: health check %s: %v", target.addr, err)
+			}
+		}(tg)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	healthy := t.targets.anyHealthy()
+	if healthy != t.health.isHealthy() {
+		if healthy {
+			log.Printf("tunnel %s -> %s healthy", t.dialAddr, t.bindAddr)
+		} else {
+			log.Printf("ERROR: tunnel %s -> %s unhealthy, all remote addresses failed their health checks", t.dialAddr, t.bindAddr)
+		}
+	}
+	t.health.setHealthy(healthy)
+}
+
+func (t *tunnel) checkTarget(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.health.config.timeout())
+	defer cancel()
+	conn, err := t.gateway.Dial(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	return t.health.config.check(conn, addr, t.remoteTLSConfigs[addr])
+}
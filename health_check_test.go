@@ -0,0 +1,121 @@
+package sshtunnel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  HealthCheckConfig
+		serve   func(conn net.Conn)
+		wantErr string
+	}{
+		{
+			name:   "tcp",
+			config: HealthCheckConfig{Type: HealthCheckTCP},
+			serve:  func(conn net.Conn) {},
+		},
+		{
+			name:   "http ok",
+			config: HealthCheckConfig{Type: HealthCheckHTTP, Path: "/healthz"},
+			serve:  serveHTTP("/healthz", "HTTP/1.1 204 No Content\r\n\r\n"),
+		},
+		{
+			name:    "http error status",
+			config:  HealthCheckConfig{Type: HealthCheckHTTP},
+			serve:   serveHTTP("/", "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n"),
+			wantErr: "503 Service Unavailable",
+		},
+		{
+			name:   "send expect",
+			config: HealthCheckConfig{Type: HealthCheckSend, Send: "PING\r\n", Expect: "+PONG"},
+			serve: func(conn net.Conn) {
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				if line == "PING\r\n" {
+					io.WriteString(conn, "+PO")
+					io.WriteString(conn, "NG\r\n")
+				}
+			},
+		},
+		{
+			name:    "unexpected response",
+			config:  HealthCheckConfig{Type: HealthCheckSend, Expect: "SSH-2.0"},
+			serve:   func(conn net.Conn) { io.WriteString(conn, "220 smtp ready\r\n") },
+			wantErr: `"SSH-2.0" not received`,
+		},
+		{
+			name:    "timeout",
+			config:  HealthCheckConfig{Type: HealthCheckSend, Expect: "ready", Timeout: 50 * time.Millisecond},
+			serve:   func(conn net.Conn) { io.Copy(io.Discard, conn) },
+			wantErr: "timeout after 50ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func(serve func(net.Conn)) {
+				defer server.Close()
+				serve(server)
+			}(tt.serve)
+			defer client.Close()
+
+			err := tt.config.check(client, "backend:80", nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("got %v, want healthy", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func serveHTTP(path, response string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.URL.Path != path || req.Host != "backend:80" {
+			io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, response)
+	}
+}
+
+func TestTargetsHealth(t *testing.T) {
+	ts := newTargets([]string{"a:1", "b:1"}, BalanceRoundRobin)
+	errCheck := errors.New("connection refused")
+
+	// unhealthy after 2 consecutive failures.
+	if got := ts.setHealth(ts.list[0], errCheck, 2); got != "" {
+		t.Errorf("first failure: got %q, want no change", got)
+	}
+	if got := ts.setHealth(ts.list[0], errCheck, 2); got != Unhealthy {
+		t.Errorf("second failure: got %q, want %s", got, Unhealthy)
+	}
+	if got := targetAddrs(ts.order()); got[0] != "b:1" || got[1] != "a:1" {
+		t.Errorf("with a unhealthy: got %v, want a last", got)
+	}
+	if !ts.anyHealthy() {
+		t.Errorf("got no healthy target with b unchecked")
+	}
+
+	ts.setHealth(ts.list[1], errCheck, 1)
+	if ts.anyHealthy() {
+		t.Errorf("got a healthy target with both unhealthy")
+	}
+	if s := ts.status(); s[1].Health != Unhealthy || s[1].HealthError != errCheck.Error() {
+		t.Errorf("status of b: got %+v", s[1])
+	}
+
+	if got := ts.setHealth(ts.list[0], nil, 2); got != Healthy || !ts.anyHealthy() {
+		t.Errorf("recovery: got %q, want %s", got, Healthy)
+	}
+}
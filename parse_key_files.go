@@ -1,6 +1,7 @@
 package sshtunnel
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -58,6 +59,9 @@ func parseKeyFiles(keyFiles []KeyFile) ([]ssh.AuthMethod, func(), error) {
 }
 
 func readKeyFile(keyFilePath string) ([]byte, error) {
+	if keyFilePath == "" {
+		return nil, errors.New("empty file path")
+	}
 	if strings.Contains(keyFilePath, "~") {
 		usr, _ := user.Current()
 		keyFilePath = strings.Replace(keyFilePath, "~", usr.HomeDir, 1)
@@ -0,0 +1,28 @@
+package sshtunnel
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredSupported reports whether peerCred is implemented.
+const peerCredSupported = true
+
+// peerCred returns the credentials of the process at the other end of conn.
+func peerCred(conn *net.UnixConn) (uid, gid int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	return int(cred.Uid), int(cred.Gid), nil
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package sshtunnel
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredSupported reports whether peerCred is implemented.
+const peerCredSupported = false
+
+// peerCred returns the credentials of the process at the other end of conn.
+func peerCred(_ *net.UnixConn) (uid, gid int, err error) {
+	return 0, 0, errors.New("peer credentials not supported on this platform")
+}
@@ -0,0 +1,248 @@
+package sshtunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds reading a PROXY protocol header from local
+// clients.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts PROXY protocol v2 headers, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+	proxyV2Unix   = 0x31
+)
+
+// checkProxyProtocol checks the PROXY protocol version of a tunnel.
+func checkProxyProtocol(version string) error {
+	switch version {
+	case "", "v1", "v2":
+		return nil
+	}
+	return fmt.Errorf("invalid proxy_protocol %s (v1 or v2)", version)
+}
+
+// writeProxyHeader writes a PROXY protocol header of the given version for
+// a connection from src to dst. Addresses other than tcp ones are sent as
+// unknown.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case "v1":
+		header = proxyHeaderV1(src, dst)
+	case "v2":
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unknown proxy protocol version %s", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyTCPAddrs returns src and dst as tcp addresses of the same family, or
+// false if either is not a tcp address.
+func proxyTCPAddrs(src, dst net.Addr) (srcIP, dstIP net.IP, srcPort, dstPort int, v4, ok bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, 0, 0, false, false
+	}
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		return s.IP.To4(), d.IP.To4(), s.Port, d.Port, true, true
+	}
+	return s.IP.To16(), d.IP.To16(), s.Port, d.Port, false, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcIP, dstIP, srcPort, dstPort, v4, ok := proxyTCPAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP6"
+	if v4 {
+		proto = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcPort, dstPort))
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(proxyV2Proxy)
+
+	srcIP, dstIP, srcPort, dstPort, v4, ok := proxyTCPAddrs(src, dst)
+	if !ok {
+		buf.Write([]byte{proxyV2Unspec, 0, 0})
+		return buf.Bytes()
+	}
+	family := byte(proxyV2TCP6)
+	if v4 {
+		family = proxyV2TCP4
+	}
+	buf.WriteByte(family)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(srcPort))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(dstPort))
+	return buf.Bytes()
+}
+
+// proxyConn is a connection whose addresses have been read from a PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.localAddr }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remoteAddr }
+
+// readProxyHeader reads and strips a PROXY protocol header, v1 or v2, from
+// conn. The returned connection reports the addresses from the header,
+// unless they are unknown or the header is a local one.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	src, dst, err := parseProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{Conn: conn, r: r, localAddr: conn.LocalAddr(), remoteAddr: conn.RemoteAddr()}
+	if src != nil && dst != nil {
+		pc.localAddr, pc.remoteAddr = dst, src
+	}
+	return pc, nil
+}
+
+func parseProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// both v1 and v2 headers are longer than the v2 signature.
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return parseProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return parseProxyHeaderV1(r)
+	}
+	return nil, nil, errors.New("no proxy header")
+}
+
+func parseProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// a v1 header is at most 107 bytes long including the CRLF.
+	var line []byte
+	for len(line) < 107 && !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read proxy header: %w", err)
+		}
+		line = append(line, b)
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy header v1 too long")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid proxy header %q", line)
+	}
+	srcAddr, err := parseProxyAddrV1(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseProxyAddrV1(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyAddrV1(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid proxy header address %s", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy header port %s", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func parseProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	command, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("read proxy header: %w", err)
+	}
+
+	switch command {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("invalid proxy header v2 command %#x", command)
+	}
+
+	// addresses are followed by optional TLVs, which are skipped.
+	var n int
+	switch family {
+	case proxyV2TCP4:
+		n = net.IPv4len
+	case proxyV2TCP6:
+		n = net.IPv6len
+	case proxyV2Unspec, proxyV2Unix:
+		return nil, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported proxy header v2 family %#x", family)
+	}
+	if len(payload) < 2*n+4 {
+		return nil, nil, errors.New("proxy header v2 too short")
+	}
+	srcAddr := &net.TCPAddr{
+		IP:   net.IP(payload[:n]),
+		Port: int(binary.BigEndian.Uint16(payload[2*n:])),
+	}
+	dstAddr := &net.TCPAddr{
+		IP:   net.IP(payload[n : 2*n]),
+		Port: int(binary.BigEndian.Uint16(payload[2*n+2:])),
+	}
+	return srcAddr, dstAddr, nil
+}
@@ -0,0 +1,81 @@
+package sshtunnel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4Src := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 51234}
+	v4Dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	v6Src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}
+	v6Dst := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 8080}
+	unixAddr := &net.UnixAddr{Name: "/tmp/test.sock", Net: "unix"}
+
+	tests := []struct {
+		version  string
+		src, dst net.Addr
+		want     string
+		wantSrc  string
+	}{
+		{"v1", v4Src, v4Dst, "PROXY TCP4 192.168.1.10 127.0.0.1 51234 8080\r\n", "192.168.1.10:51234"},
+		{"v1", v6Src, v6Dst, "PROXY TCP6 2001:db8::1 ::1 51234 8080\r\n", "[2001:db8::1]:51234"},
+		{"v1", unixAddr, unixAddr, "PROXY UNKNOWN\r\n", ""},
+		{"v2", v4Src, v4Dst, "", "192.168.1.10:51234"},
+		{"v2", v6Src, v6Dst, "", "[2001:db8::1]:51234"},
+		{"v2", unixAddr, unixAddr, "", ""},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, tt.version, tt.src, tt.dst); err != nil {
+			t.Fatalf("writeProxyHeader: %v", err)
+		}
+		if tt.want != "" && buf.String() != tt.want {
+			t.Errorf("%s %s: got header %q, want %q", tt.version, tt.src, buf.String(), tt.want)
+		}
+		buf.WriteString("payload")
+
+		client, server := net.Pipe()
+		go func(header []byte) {
+			defer client.Close()
+			_, _ = client.Write(header)
+		}(buf.Bytes())
+
+		conn, err := readProxyHeader(server)
+		if err != nil {
+			t.Fatalf("%s %s: readProxyHeader: %v", tt.version, tt.src, err)
+		}
+		wantSrc := tt.wantSrc
+		if wantSrc == "" {
+			wantSrc = server.RemoteAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != wantSrc {
+			t.Errorf("%s %s: got remote address %s, want %s", tt.version, tt.src, got, wantSrc)
+		}
+		rest, err := ioutil.ReadAll(conn)
+		if err != nil || string(rest) != "payload" {
+			t.Errorf("%s %s: got payload %q (%v), want %q", tt.version, tt.src, rest, err, "payload")
+		}
+		server.Close()
+	}
+}
+
+func TestProxyHeaderInvalid(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 1.2.3.4\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 70000 80\r\n",
+	} {
+		client, server := net.Pipe()
+		go func(header string) {
+			defer client.Close()
+			_, _ = client.Write([]byte(header))
+		}(header)
+		if _, err := readProxyHeader(server); err == nil {
+			t.Errorf("%q: got no error", header)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package sshtunnel
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled at rate tokens per second up to
+// burst tokens, a rate of 0 is unlimited. A nil rateLimiter allows
+// everything.
+type rateLimiter struct {
+	mux    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter starting with a full bucket, or nil
+// if rate is not positive. burst defaults to rate rounded up.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	l := &rateLimiter{}
+	l.setRate(rate, burst)
+	return l
+}
+
+// setRate changes the rate and burst, keeping the tokens earned so far.
+func (l *rateLimiter) setRate(rate float64, burst int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	unlimited := l.rate <= 0
+	l.refill(now)
+	l.rate = rate
+	l.burst = float64(burst)
+	if burst <= 0 {
+		l.burst = math.Ceil(rate)
+	}
+	if unlimited || l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// allow takes a token if there is one.
+func (l *rateLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// wait takes n tokens and waits until they have been earned if the bucket
+// runs short. The bucket goes into debt meanwhile, so n may exceed the burst.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mux.Lock()
+	if l.rate <= 0 {
+		l.mux.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mux.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refill adds the tokens earned since the last refill, it must be called
+// with l.mux held.
+func (l *rateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
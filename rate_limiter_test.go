@@ -0,0 +1,62 @@
+package sshtunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	if l := newRateLimiter(0, 0); l != nil || !l.allow() {
+		t.Fatalf("zero rate: got %v, want nil limiter allowing everything", l)
+	}
+
+	l := newRateLimiter(2, 3)
+	for i := 0; i < 3; i++ {
+		if !l.allow() {
+			t.Fatalf("burst %d: got denied", i)
+		}
+	}
+	if l.allow() {
+		t.Fatalf("beyond burst: got allowed")
+	}
+
+	// half a second refills a token at 2/s.
+	l.mux.Lock()
+	l.last = l.last.Add(-500 * time.Millisecond)
+	l.mux.Unlock()
+	if !l.allow() {
+		t.Fatalf("after refill: got denied")
+	}
+	if l.allow() {
+		t.Fatalf("after refill: got a second token")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := newRateLimiter(1000, 100)
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := l.wait(ctx, 100); err != nil {
+		t.Fatalf("wait burst: %v", err)
+	}
+	if err := l.wait(ctx, 50); err != nil {
+		t.Fatalf("wait beyond burst: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("got %v for 150 bytes at 1000/s with a burst of 100, want about 50ms", elapsed)
+	}
+
+	// the debt of a write larger than the burst is cut short by ctx.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, 10000); err == nil {
+		t.Errorf("wait with canceled ctx: got no error")
+	}
+
+	l.setRate(0, 0)
+	if err := l.wait(context.Background(), 1<<20); err != nil || !l.allow() {
+		t.Errorf("unlimited: got %v", err)
+	}
+}
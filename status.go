@@ -0,0 +1,82 @@
+package sshtunnel
+
+import (
+	"time"
+)
+
+const (
+	GatewayIdle       = "idle"
+	GatewayConnecting = "connecting"
+	GatewayConnected  = "connected"
+	GatewayFailed     = "failed"
+	GatewayClosed     = "closed"
+)
+
+const (
+	TunnelStarting  = "starting"
+	TunnelListening = "listening"
+	TunnelDraining  = "draining"
+	// TunnelUnhealthy has closed its listener while all of its remote
+	// addresses fail their health checks.
+	TunnelUnhealthy = "unhealthy"
+	TunnelFailed    = "failed"
+	TunnelStopped   = "stopped"
+)
+
+// GatewayStatus is a snapshot of the ssh connection state of a gateway.
+type GatewayStatus struct {
+	Server         string    `json:"server"`
+	State          string    `json:"state"`
+	ConnectedSince time.Time `json:"connected_since"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	Reconnects     int       `json:"reconnects"`
+	Channels       int64     `json:"channels"`
+	OnDemand       bool      `json:"on_demand,omitempty"`
+	// MaxChannels is 0 if unlimited.
+	MaxChannels      int   `json:"max_channels,omitempty"`
+	RejectedChannels int64 `json:"rejected_channels"`
+	// Pool lists the ssh connections of a gateway with more than one.
+	Pool       []PoolConnStatus `json:"pool,omitempty"`
+	PoolPolicy string           `json:"pool_policy,omitempty"`
+}
+
+// PoolConnStatus is a snapshot of one of the ssh connections of a gateway.
+type PoolConnStatus struct {
+	State          string    `json:"state"`
+	ConnectedSince time.Time `json:"connected_since"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	Reconnects     int       `json:"reconnects"`
+	Channels       int64     `json:"channels"`
+}
+
+// TunnelStatus is a snapshot of the listener state and traffic of a tunnel.
+type TunnelStatus struct {
+	Name          string `json:"name,omitempty"`
+	BindAddr      string `json:"bind_addr"`
+	DialAddr      string `json:"dial_addr"`
+	State         string `json:"state"`
+	LastError     string `json:"last_error,omitempty"`
+	ActiveConns   int64  `json:"active_conns"`
+	TotalConns    int64  `json:"total_conns"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	DeniedConns   int64  `json:"denied_conns"`
+	RejectedConns int64  `json:"rejected_conns"`
+	// Health is the result of the health checks, empty without them.
+	Health      string `json:"health,omitempty"`
+	HealthError string `json:"health_error,omitempty"`
+	// Targets lists the remote addresses of a tunnel with more than one.
+	Targets []TargetStatus `json:"targets,omitempty"`
+}
+
+// TargetStatus is a snapshot of one of the remote addresses of a tunnel.
+type TargetStatus struct {
+	Addr        string `json:"addr"`
+	Up          bool   `json:"up"`
+	ActiveConns int64  `json:"active_conns"`
+	Failures    int64  `json:"failures"`
+	Health      string `json:"health,omitempty"`
+	HealthError string `json:"health_error,omitempty"`
+}
@@ -0,0 +1,198 @@
+package sshtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Policies balancing the connections of a tunnel across its remote
+// addresses.
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+)
+
+// targetDownTime is how long a remote address is avoided after a failed
+// dial, it is only dialed meanwhile if all addresses are down.
+const targetDownTime = 30 * time.Second
+
+// targets balances the connections of a tunnel across its remote
+// addresses.
+type targets struct {
+	mux    sync.Mutex
+	list   []*target
+	policy string
+	next   int
+}
+
+type target struct {
+	addr        string
+	activeConns int64
+	failures    int64
+	downUntil   time.Time
+
+	// health is the result of the health checks, checkFailures counts the
+	// consecutive failed ones.
+	health        string
+	healthErr     error
+	checkFailures int
+}
+
+func newTargets(addrs []string, policy string) *targets {
+	ts := &targets{policy: policy}
+	for _, addr := range addrs {
+		ts.list = append(ts.list, &target{addr: addr})
+	}
+	return ts
+}
+
+// order returns the targets in the order to dial them: the ones up by the
+// balance policy, then the ones down or unhealthy.
+func (ts *targets) order() []*target {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+
+	var balanced []*target
+	switch ts.policy {
+	case BalanceLeastConnections:
+		balanced = append(balanced, ts.list...)
+		// a stable insertion sort keeps the configured order among equals.
+		for i := 1; i < len(balanced); i++ {
+			for j := i; j > 0 && atomic.LoadInt64(&balanced[j].activeConns) < atomic.LoadInt64(&balanced[j-1].activeConns); j-- {
+				balanced[j], balanced[j-1] = balanced[j-1], balanced[j]
+			}
+		}
+	default:
+		for i := range ts.list {
+			balanced = append(balanced, ts.list[(ts.next+i)%len(ts.list)])
+		}
+		ts.next++
+	}
+
+	now := time.Now()
+	var ordered, down []*target
+	for _, t := range balanced {
+		if now.Before(t.downUntil) || t.health == Unhealthy {
+			down = append(down, t)
+		} else {
+			ordered = append(ordered, t)
+		}
+	}
+	return append(ordered, down...)
+}
+
+func (ts *targets) markDown(t *target) {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	t.downUntil = time.Now().Add(targetDownTime)
+	t.failures++
+}
+
+func (ts *targets) markUp(t *target) {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	t.downUntil = time.Time{}
+}
+
+// setHealth records the result of a health check of t, it becomes unhealthy
+// after failures consecutive failed checks. It returns the new health if it
+// has changed, or "".
+func (ts *targets) setHealth(t *target, err error, failures int) string {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+
+	health := Healthy
+	if err != nil {
+		t.healthErr = err
+		t.checkFailures++
+		if t.checkFailures < failures && t.health != Unhealthy {
+			return ""
+		}
+		health = Unhealthy
+	} else {
+		t.healthErr = nil
+		t.checkFailures = 0
+	}
+	if t.health == health {
+		return ""
+	}
+	t.health = health
+	return health
+}
+
+// anyHealthy reports whether any target has not failed its health checks.
+func (ts *targets) anyHealthy() bool {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	for _, t := range ts.list {
+		if t.health != Unhealthy {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *targets) status() []TargetStatus {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+
+	now := time.Now()
+	statuses := make([]TargetStatus, 0, len(ts.list))
+	for _, t := range ts.list {
+		s := TargetStatus{
+			Addr:        t.addr,
+			Up:          !now.Before(t.downUntil),
+			ActiveConns: atomic.LoadInt64(&t.activeConns),
+			Failures:    t.failures,
+			Health:      t.health,
+		}
+		if t.healthErr != nil {
+			s.HealthError = t.healthErr.Error()
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// dialTarget dials the remote addresses through the gateway until one
+// accepts the channel, addresses refusing it are marked down. It returns the
+// address dialed, whose connection count is released when the connection is
+// closed.
+func (t *tunnel) dialTarget(ctx context.Context) (net.Conn, string, error) {
+	var errs []error
+	order := t.targets.order()
+	for i, target := range order {
+		conn, err := t.gateway.Dial(ctx, "tcp", target.addr)
+		if err == nil {
+			t.targets.markUp(target)
+			atomic.AddInt64(&target.activeConns, 1)
+			return &channelConn{Conn: conn, done: func() {
+				atomic.AddInt64(&target.activeConns, -1)
+			}}, target.addr, nil
+		}
+
+		// only a refused channel is the fault of the remote address, the
+		// others would fail the same with another address.
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) {
+			return nil, target.addr, err
+		}
+		t.targets.markDown(target)
+		errs = append(errs, fmt.Errorf("%s: %w", target.addr, err))
+		if i < len(order)-1 {
+			log.Printf("ERROR: dial %s: %v, trying the next remote address", target.addr, err)
+		}
+	}
+	if len(errs) == 1 {
+		return nil, order[0].addr, errors.Unwrap(errs[0])
+	}
+	return nil, t.dialAddr, fmt.Errorf("all remote addresses failed: %v", errs)
+}
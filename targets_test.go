@@ -0,0 +1,43 @@
+package sshtunnel
+
+import (
+	"testing"
+)
+
+func targetAddrs(ts []*target) []string {
+	var addrs []string
+	for _, t := range ts {
+		addrs = append(addrs, t.addr)
+	}
+	return addrs
+}
+
+func TestTargetsOrder(t *testing.T) {
+	ts := newTargets([]string{"a:1", "b:1", "c:1"}, BalanceRoundRobin)
+	for i, want := range []string{"a:1", "b:1", "c:1", "a:1"} {
+		if got := ts.order()[0].addr; got != want {
+			t.Errorf("round robin %d: got %s first, want %s", i, got, want)
+		}
+	}
+
+	// down targets are dialed last.
+	ts.markDown(ts.list[1])
+	if got := targetAddrs(ts.order()); got[0] != "c:1" || got[2] != "b:1" {
+		t.Errorf("round robin with b down: got %v", got)
+	}
+	ts.markUp(ts.list[1])
+
+	ts = newTargets([]string{"a:1", "b:1", "c:1"}, BalanceLeastConnections)
+	ts.list[0].activeConns = 2
+	ts.list[1].activeConns = 1
+	if got := targetAddrs(ts.order()); got[0] != "c:1" || got[1] != "b:1" || got[2] != "a:1" {
+		t.Errorf("least connections: got %v", got)
+	}
+	ts.markDown(ts.list[2])
+	if got := targetAddrs(ts.order()); got[0] != "b:1" || got[2] != "c:1" {
+		t.Errorf("least connections with c down: got %v", got)
+	}
+	if s := ts.status(); s[2].Up || s[2].Failures != 1 {
+		t.Errorf("status of c: got %+v, want down with 1 failure", s[2])
+	}
+}
@@ -0,0 +1,126 @@
+package sshtunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the tls handshakes with local clients and
+// remote servers.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig terminates tls on the local side of a tunnel.
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA requires clients to present certificates signed by it.
+	ClientCA string `yaml:"client_ca"`
+}
+
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	if c.Cert == "" || c.Key == "" {
+		return nil, errors.New("tls requires cert and key")
+	}
+	cert, err := loadKeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.ClientCA != "" {
+		pool, err := loadCertPool(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("client ca: %w", err)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// RemoteTLSConfig originates tls towards the remote address of a tunnel.
+type RemoteTLSConfig struct {
+	// ServerName is sent as SNI and verified, it defaults to the host of
+	// the remote address.
+	ServerName string `yaml:"server_name"`
+	// CA verifies the server certificate instead of the system roots.
+	CA                 string `yaml:"ca"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// Cert and Key are presented to servers requiring client certificates.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (c *RemoteTLSConfig) clientConfig(dialAddr string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(dialAddr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if c.CA != "" {
+		pool, err := loadCertPool(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("ca: %w", err)
+		}
+		config.RootCAs = pool
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, errors.New("cert and key must be given together")
+	}
+	if c.Cert != "" {
+		cert, err := loadKeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := readKeyFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read cert: %w", err)
+	}
+	keyPEM, err := readKeyFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load key pair %s: %w", certFile, err)
+	}
+	return cert, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// tlsHandshake runs the handshake of conn within tlsHandshakeTimeout. The
+// connection is closed on timeout, as ssh channels do not support deadlines.
+func tlsHandshake(conn *tls.Conn) error {
+	timer := time.AfterFunc(tlsHandshakeTimeout, func() { _ = conn.Close() })
+	err := conn.Handshake()
+	if !timer.Stop() {
+		return fmt.Errorf("timeout after %v", tlsHandshakeTimeout)
+	}
+	return err
+}
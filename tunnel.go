@@ -2,101 +2,686 @@ package sshtunnel
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type tunnel struct {
 	gateway *Gateway
 
-	dialAddr string
-	bindAddr string
+	name        string
+	dialAddr    string
+	bindAddr    string
+	bindNetwork string
+
+	drainTimeout time.Duration
+
+	access *accessPolicy
+	perm   socketPerm
+
+	// targets are the remote addresses dialed, dialAddr lists them.
+	targets *targets
+
+	// tlsConfig terminates tls of accepted connections, remoteTLSConfigs
+	// originate tls on dialed ones by remote address.
+	tlsConfig        *tls.Config
+	remoteTLSConfigs map[string]*tls.Config
+
+	// proxyProtocol is the PROXY protocol version written to dialed
+	// connections, acceptProxyProtocol reads it from accepted ones.
+	proxyProtocol       string
+	acceptProxyProtocol bool
+
+	// slots holds a token per connection being forwarded if the
+	// connections are limited, queueConns waits for a free slot instead of
+	// rejecting connections.
+	slots       chan struct{}
+	queueConns  bool
+	connLimiter *rateLimiter
+
+	// upload and download shape the traffic of the tunnel, within the
+	// limits of the gateway.
+	upload   *rateLimiter
+	download *rateLimiter
+
+	// idleTimeout and maxLifetime close forwarded connections, 0 disables
+	// them.
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	// health checks the remote addresses if configured.
+	health *healthChecker
+
+	statMux sync.RWMutex
+	state   string
+	lastErr error
+
+	activeConns   int64
+	totalConns    int64
+	bytesSent     int64
+	bytesReceived int64
+	deniedConns   int64
+	rejectedConns int64
 }
 
 func NewTunnel(
 	gateway *Gateway,
 	tunnelStr string, // remoteAddr:port -> 127.0.0.1:port
 ) (*tunnel, error) {
+	c, err := ParseTunnelConfig(tunnelStr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTunnelFromConfig(gateway, c)
+}
+
+// NewTunnelFromConfig creates a tunnel forwarding connections accepted on
+// c.Local to c.Remote through the gateway.
+func NewTunnelFromConfig(gateway *Gateway, c TunnelConfig) (*tunnel, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	access, err := newAccessPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+	perm, err := newSocketPerm(c)
+	if err != nil {
+		return nil, err
+	}
+	var remotes []string
+	for _, remote := range c.RemoteList() {
+		remotes = append(remotes, resolvePort(remote))
+	}
+	t := &tunnel{
+		gateway:     gateway,
+		name:        c.Name,
+		dialAddr:    strings.Join(remotes, ","),
+		targets:     newTargets(remotes, c.Balance),
+		bindAddr:    c.Local,
+		bindNetwork: c.Type,
+		access:      access,
+		perm:        perm,
+		state:       TunnelStarting,
+
+		proxyProtocol:       c.ProxyProtocol,
+		acceptProxyProtocol: c.AcceptProxyProtocol,
+
+		queueConns:  c.QueueConnections,
+		connLimiter: newRateLimiter(c.ConnRate, c.ConnBurst),
+		upload:      &rateLimiter{},
+		download:    &rateLimiter{},
+		idleTimeout: c.IdleTimeout,
+		maxLifetime: c.MaxLifetime,
+	}
+	upload, download, err := c.Bandwidth()
+	if err != nil {
+		return nil, err
+	}
+	t.SetBandwidth(upload, download)
+	if c.HealthCheck != nil {
+		t.health = newHealthChecker(c.HealthCheck)
+	}
+	if c.MaxConnections > 0 {
+		t.slots = make(chan struct{}, c.MaxConnections)
+	}
+	if c.TLS != nil {
+		if t.tlsConfig, err = c.TLS.serverConfig(); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	if c.RemoteTLS != nil {
+		t.remoteTLSConfigs = make(map[string]*tls.Config)
+		for _, remote := range remotes {
+			if t.remoteTLSConfigs[remote], err = c.RemoteTLS.clientConfig(remote); err != nil {
+				return nil, fmt.Errorf("remote tls: %w", err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// parseTunnel parses remoteAddr:port -> 127.0.0.1:port into the dial and
+// bind addresses, the bind address can also be a unix socket path.
+func parseTunnel(tunnelStr string) (dialAddr, bindAddr string, err error) {
+	dialAddr, bindAddr, err = splitTunnel(tunnelStr)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkTunnelAddrs(dialAddr, bindAddr); err != nil {
+		return "", "", err
+	}
+	return dialAddr, bindAddr, nil
+}
+
+func splitTunnel(tunnelStr string) (dialAddr, bindAddr string, err error) {
 	tunnelInfo := strings.Split(tunnelStr, "->")
 	if len(tunnelInfo) != 2 {
-		return nil, errors.New("invalid tunnel format (e.g. remoteAddr:port -> 127.0.0.1:port)")
+		return "", "", errors.New("invalid tunnel format (e.g. remoteAddr:port -> 127.0.0.1:port)")
 	}
-	return &tunnel{
-		gateway:  gateway,
-		dialAddr: strings.TrimSpace(tunnelInfo[0]),
-		bindAddr: strings.TrimSpace(tunnelInfo[1]),
-	}, nil
+	return strings.TrimSpace(tunnelInfo[0]), strings.TrimSpace(tunnelInfo[1]), nil
 }
 
+func checkTunnelAddrs(dialAddr, bindAddr string) error {
+	if err := checkHostPort(dialAddr); err != nil {
+		return fmt.Errorf("invalid remote address %s: %w", dialAddr, err)
+	}
+	if bindAddr == "" {
+		return errors.New("empty bind address")
+	}
+	if _, _, err := net.SplitHostPort(bindAddr); err == nil {
+		if err := checkHostPort(bindAddr); err != nil {
+			return fmt.Errorf("invalid bind address %s: %w", bindAddr, err)
+		}
+	}
+	return nil
+}
+
+// checkHostPort checks the port of addr is a number or a service name.
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if port == "" {
+		return errors.New("missing port")
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid port %s", port)
+	}
+	return nil
+}
+
+// resolvePort replaces a service name port of addr by its number, as ssh
+// channels are opened to numeric ports only.
+func resolvePort(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	n, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n))
+}
+
+// SetBandwidth limits the traffic of the tunnel to upload and download bytes
+// per second, 0 is unlimited. It applies to connections being forwarded too.
+func (t *tunnel) SetBandwidth(upload, download int64) {
+	t.upload.setRate(float64(upload), 0)
+	t.download.setRate(float64(download), 0)
+}
+
+// SetDrainTimeout sets how long Forward waits for in-flight connections to
+// finish once it has stopped accepting, they are closed when it expires.
+func (t *tunnel) SetDrainTimeout(d time.Duration) {
+	t.drainTimeout = d
+}
+
+// Forward accepts connections on the bind address and forwards them through
+// the gateway until ctx is done. It then stops accepting and drains in-flight
+// connections before returning.
 func (t *tunnel) Forward(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	bindListener, err := closableListen(t.bindAddr)
+	// accepted connections outlive ctx until they are drained.
+	connCtx, closeConns := context.WithCancel(context.Background())
+	defer closeConns()
+
+	t.setState(TunnelStarting, nil)
+	bindListener, err := closableListen(t.name, t.bindNetwork, t.bindAddr, t.perm)
 	if err != nil {
-		return fmt.Errorf("listen to bind address - %s: %w", t.bindAddr, err)
+		err = fmt.Errorf("listen to bind address - %s: %w", t.bindAddr, err)
+		t.setState(TunnelFailed, err)
+		return err
 	}
-	defer bindListener.Close()
+	defer func() { bindListener.Close() }()
+
+	t.setState(TunnelListening, nil)
+	defer t.setState(TunnelStopped, nil)
 
 	log.Printf("start forwarding: %s -> %s", t.dialAddr, t.bindAddr)
 	defer log.Printf("stop forwarding: %s -> %s", t.dialAddr, t.bindAddr)
 
-	t.startAccept(ctx, bindListener)
+	if t.health != nil {
+		go t.checkHealth(ctx)
+	}
+
+	var conns connGroup
+	for {
+		acceptCtx, stopAccept := context.WithCancel(ctx)
+		if t.health != nil && t.health.config.CloseListener {
+			go t.stopWhenUnhealthy(acceptCtx, stopAccept)
+		}
+		t.startAccept(acceptCtx, connCtx, bindListener, &conns)
+		stopAccept()
+		if ctx.Err() != nil || t.Status().State == TunnelFailed {
+			bindListener.Close()
+			break
+		}
+
+		// all remote addresses are unhealthy, listen again once one
+		// recovers. In-flight connections are left to finish meanwhile.
+		// Inherited sockets keep listening when closed, they are only not
+		// accepted from until then.
+		if bindListener.inherited {
+			log.Printf("stop accepting on %s until %s is healthy", t.bindAddr, t.dialAddr)
+		} else {
+			bindListener.Close()
+			log.Printf("stop listening to %s until %s is healthy", t.bindAddr, t.dialAddr)
+		}
+		t.setState(TunnelUnhealthy, nil)
+		if !t.waitHealthy(ctx) {
+			break
+		}
+		if bindListener.inherited {
+			bindListener.resume()
+			log.Printf("accepting on %s again", t.bindAddr)
+		} else {
+			if bindListener, err = closableListen(t.name, t.bindNetwork, t.bindAddr, t.perm); err != nil {
+				err = fmt.Errorf("listen to bind address - %s: %w", t.bindAddr, err)
+				log.Printf("ERROR: %v", err)
+				t.setState(TunnelFailed, err)
+				break
+			}
+			log.Printf("listening to %s again", t.bindAddr)
+		}
+		t.setState(TunnelListening, nil)
+	}
+
+	t.setState(TunnelDraining, nil)
+	t.drain(&conns, closeConns)
 	return nil
 }
 
-func (t *tunnel) startAccept(ctx context.Context, bindListener *closableListener) {
-	// close bind listener to stop accepting if ctx is canceled.
+// stopWhenUnhealthy calls stop once the tunnel is unhealthy, or returns when
+// ctx is done.
+func (t *tunnel) stopWhenUnhealthy(ctx context.Context, stop func()) {
+	for t.health.isHealthy() {
+		select {
+		case <-t.health.changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+	stop()
+}
+
+// waitHealthy waits until the tunnel is healthy, it returns false if ctx is
+// done first.
+func (t *tunnel) waitHealthy(ctx context.Context) bool {
+	for !t.health.isHealthy() {
+		select {
+		case <-t.health.changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tunnel) startAccept(ctx, connCtx context.Context, bindListener *closableListener, conns *connGroup) {
+	// close bind listener to stop accepting if ctx is canceled, inherited
+	// ones are paused instead to accept again once healthy.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
 	go func() {
-		<-ctx.Done()
-		bindListener.Close()
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		if bindListener.inherited {
+			bindListener.pause()
+		} else {
+			bindListener.Close()
+		}
+	}()
+	defer func() {
+		close(done)
+		<-stopped
 	}()
 
 	for {
 		bindConn, err := bindListener.Accept()
-		if bindListener.IsClosed() {
+		if bindListener.IsClosed() || bindListener.isPaused() {
 			break
 		}
 		if err != nil {
 			log.Printf("ERROR: accept %s: %v", t.bindAddr, err)
+			t.setState(TunnelFailed, fmt.Errorf("accept: %w", err))
 			break
 		}
 
+		if err := t.access.check(bindConn); err != nil {
+			log.Printf("denied %s -> %s: %v", t.bindAddr, bindConn.RemoteAddr(), err)
+			atomic.AddInt64(&t.deniedConns, 1)
+			_ = bindConn.Close()
+			continue
+		}
+
+		if err := t.admit(ctx); err != nil {
+			_ = bindConn.Close()
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("rejected %s -> %s: %v", t.bindAddr, bindConn.RemoteAddr(), err)
+			atomic.AddInt64(&t.rejectedConns, 1)
+			continue
+		}
+
 		log.Printf("accepted %s -> %s", t.bindAddr, bindConn.RemoteAddr())
+		atomic.AddInt64(&t.totalConns, 1)
+		atomic.AddInt64(&t.activeConns, 1)
+		conns.add()
 		go func(bindConn net.Conn) {
+			defer conns.done()
+			defer t.release()
+			defer atomic.AddInt64(&t.activeConns, -1)
 			defer log.Printf("disconnected %s -> %s", t.bindAddr, bindConn.RemoteAddr())
-			defer bindConn.Close()
+			// closes the tls connection once bindConn is replaced by it, so
+			// that close_notify is sent.
+			defer func() { _ = bindConn.Close() }()
+
+			if t.acceptProxyProtocol {
+				proxyConn, err := readProxyHeader(bindConn)
+				if err != nil {
+					log.Printf("ERROR: proxy header from %s: %v", bindConn.RemoteAddr(), err)
+					return
+				}
+				log.Printf("proxied %s -> %s", t.bindAddr, proxyConn.RemoteAddr())
+				bindConn = proxyConn
+			}
 
-			dialConn, err := t.gateway.Dial(ctx, "tcp", t.dialAddr)
+			if t.tlsConfig != nil {
+				tlsConn := tls.Server(bindConn, t.tlsConfig)
+				if err := tlsHandshake(tlsConn); err != nil {
+					log.Printf("ERROR: tls handshake with %s: %v", bindConn.RemoteAddr(), err)
+					return
+				}
+				bindConn = tlsConn
+			}
+
+			dialConn, dialAddr, err := t.dialTarget(connCtx)
+			if errors.Is(err, ErrChannelLimit) {
+				log.Printf("rejected %s -> %s: gateway %v", t.bindAddr, bindConn.RemoteAddr(), err)
+				atomic.AddInt64(&t.rejectedConns, 1)
+				return
+			}
 			if err != nil {
-				log.Printf("ERROR: dial %s: %v", t.dialAddr, err)
+				log.Printf("ERROR: dial %s: %v", dialAddr, err)
 				return
 			}
-			defer dialConn.Close()
+			defer func() { _ = dialConn.Close() }()
+
+			if t.proxyProtocol != "" {
+				if err := writeProxyHeader(dialConn, t.proxyProtocol, bindConn.RemoteAddr(), bindConn.LocalAddr()); err != nil {
+					log.Printf("ERROR: proxy header to %s: %v", dialAddr, err)
+					return
+				}
+			}
 
-			ctx, cancel := context.WithCancel(ctx)
+			if config := t.remoteTLSConfigs[dialAddr]; config != nil {
+				tlsConn := tls.Client(dialConn, config)
+				if err := tlsHandshake(tlsConn); err != nil {
+					log.Printf("ERROR: tls handshake with %s: %v", dialAddr, err)
+					return
+				}
+				dialConn = tlsConn
+			}
+
+			ctx, cancel := context.WithCancel(connCtx)
 			defer cancel()
 			t.biCopy(ctx, dialConn, bindConn)
 		}(bindConn)
 	}
 }
 
+// admit takes a slot for an accepted connection within the connection rate
+// and limit. Without a free slot, it waits for one until ctx is done if
+// connections are queued, or fails otherwise.
+func (t *tunnel) admit(ctx context.Context) error {
+	if !t.connLimiter.allow() {
+		return fmt.Errorf("connection rate of %v/s exceeded", t.connLimiter.rate)
+	}
+	if t.slots == nil {
+		return nil
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if !t.queueConns {
+		return fmt.Errorf("%d connections limit reached", cap(t.slots))
+	}
+	// further clients wait in the listen backlog meanwhile.
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by admit.
+func (t *tunnel) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// drain waits for in-flight connections to finish for up to the drain
+// timeout, and closes the remaining ones after that.
+func (t *tunnel) drain(conns *connGroup, closeConns func()) {
+	if conns.len() == 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		conns.wg.Wait()
+		close(done)
+	}()
+
+	log.Printf("draining %d connections of %s", conns.len(), t.bindAddr)
+	timer := time.NewTimer(t.drainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("drain timeout of %s, closing %d connections", t.bindAddr, conns.len())
+		closeConns()
+		<-done
+	}
+}
+
+// connGroup tracks the in-flight connections accepted by a listener.
+type connGroup struct {
+	wg sync.WaitGroup
+	n  int64
+}
+
+func (g *connGroup) add() {
+	atomic.AddInt64(&g.n, 1)
+	g.wg.Add(1)
+}
+
+func (g *connGroup) done() {
+	atomic.AddInt64(&g.n, -1)
+	g.wg.Done()
+}
+
+func (g *connGroup) len() int64 {
+	return atomic.LoadInt64(&g.n)
+}
+
+// biCopy copies between dialConn and bindConn until either is closed, the
+// connection has been idle for the idle timeout or has reached its maximum
+// lifetime. The caller closes the connections.
 func (t *tunnel) biCopy(ctx context.Context, dialConn, bindConn net.Conn) {
+	lastActive := time.Now().UnixNano()
 	errCh := make(chan error)
-	go copy(ctx, dialConn, bindConn, fmt.Sprintf("copy %s -> %s", t.dialAddr, t.bindAddr), errCh)
-	go copy(ctx, bindConn, dialConn, fmt.Sprintf("copy %s -> %s", t.bindAddr, t.dialAddr), errCh)
+	upload := &shapingWriter{ctx: ctx, w: dialConn, limiters: []*rateLimiter{t.upload, t.gateway.upload}}
+	download := &shapingWriter{ctx: ctx, w: bindConn, limiters: []*rateLimiter{t.download, t.gateway.download}}
+	go copy(ctx, &countingWriter{w: upload, n: &t.bytesSent, last: &lastActive}, bindConn, fmt.Sprintf("copy %s -> %s", t.dialAddr, t.bindAddr), errCh)
+	go copy(ctx, &countingWriter{w: download, n: &t.bytesReceived, last: &lastActive}, dialConn, fmt.Sprintf("copy %s -> %s", t.bindAddr, t.dialAddr), errCh)
 
-	select {
-	case <-ctx.Done():
-	case err := <-errCh:
+	var idleTimer *time.Timer
+	var idleC, lifetimeC <-chan time.Time
+	if t.idleTimeout > 0 {
+		idleTimer = time.NewTimer(t.idleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if t.maxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(t.maxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetimeC = lifetimeTimer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-errCh:
+			if err != nil {
+				log.Printf("ERROR: biCopy: %v", err)
+			}
+			return
+		case <-idleC:
+			// check again when the timeout has passed since the last write.
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActive)))
+			if idle < t.idleTimeout {
+				idleTimer.Reset(t.idleTimeout - idle)
+				continue
+			}
+			log.Printf("close %s -> %s: idle for %v", t.bindAddr, bindConn.RemoteAddr(), t.idleTimeout)
+			return
+		case <-lifetimeC:
+			log.Printf("close %s -> %s: max lifetime %v reached", t.bindAddr, bindConn.RemoteAddr(), t.maxLifetime)
+			return
+		}
+	}
+}
+
+// Status returns a snapshot of the tunnel listener state and traffic.
+func (t *tunnel) Status() TunnelStatus {
+	t.statMux.RLock()
+	defer t.statMux.RUnlock()
+
+	s := TunnelStatus{
+		Name:          t.name,
+		BindAddr:      t.bindAddr,
+		DialAddr:      t.dialAddr,
+		State:         t.state,
+		ActiveConns:   atomic.LoadInt64(&t.activeConns),
+		TotalConns:    atomic.LoadInt64(&t.totalConns),
+		BytesSent:     atomic.LoadInt64(&t.bytesSent),
+		BytesReceived: atomic.LoadInt64(&t.bytesReceived),
+		DeniedConns:   atomic.LoadInt64(&t.deniedConns),
+		RejectedConns: atomic.LoadInt64(&t.rejectedConns),
+	}
+	if t.lastErr != nil {
+		s.LastError = t.lastErr.Error()
+	}
+	if len(t.targets.list) > 1 {
+		s.Targets = t.targets.status()
+	}
+	if t.health != nil {
+		s.Health = Healthy
+		if !t.health.isHealthy() {
+			s.Health = Unhealthy
+		}
+		// a single remote address has no target rows to show its error.
+		if ts := t.targets.status(); len(ts) == 1 {
+			s.HealthError = ts[0].HealthError
+		}
+	}
+	return s
+}
+
+func (t *tunnel) setState(state string, err error) {
+	t.statMux.Lock()
+	defer t.statMux.Unlock()
+
+	// keep the failure visible after the listener has been torn down.
+	if (state == TunnelDraining || state == TunnelStopped) && t.state == TunnelFailed {
+		return
+	}
+	t.state = state
+	if err != nil {
+		t.lastErr = err
+	}
+}
+
+// countingWriter counts the bytes written to w, and records the time of the
+// last write in last if set.
+type countingWriter struct {
+	w    io.Writer
+	n    *int64
+	last *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	// a write held back by bandwidth limits is not idle either.
+	w.touch()
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	w.touch()
+	return n, err
+}
+
+func (w *countingWriter) touch() {
+	if w.last != nil {
+		atomic.StoreInt64(w.last, time.Now().UnixNano())
+	}
+}
+
+// shapingChunk is the largest write of a shapingWriter, so that traffic is
+// spread evenly under low limits.
+const shapingChunk = 16 * 1024
+
+// shapingWriter waits for the limiters to allow the bytes it writes.
+type shapingWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+func (w *shapingWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > shapingChunk {
+			chunk = chunk[:shapingChunk]
+		}
+		for _, l := range w.limiters {
+			if err := l.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.w.Write(chunk)
+		written += n
 		if err != nil {
-			log.Printf("ERROR: biCopy: %v", err)
+			return written, err
 		}
+		p = p[n:]
 	}
+	return written, nil
 }
 
 func copy(ctx context.Context, dst io.Writer, src io.Reader, msg string, errCh chan<- error) {
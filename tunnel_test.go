@@ -0,0 +1,94 @@
+package sshtunnel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// biCopyPipes runs biCopy of tn between pipes, writing to the returned
+// client conn is forwarded to a sink. It returns when biCopy has returned
+// and how long it took.
+func biCopyPipes(tn *tunnel) (client net.Conn, done <-chan time.Duration) {
+	client, bindConn := net.Pipe()
+	dialConn, server := net.Pipe()
+	go func() { _, _ = io.Copy(ioutil.Discard, server) }()
+
+	ch := make(chan time.Duration, 1)
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		start := time.Now()
+		tn.biCopy(ctx, dialConn, bindConn)
+		ch <- time.Since(start)
+		for _, c := range []net.Conn{client, bindConn, dialConn, server} {
+			c.Close()
+		}
+	}()
+	return client, ch
+}
+
+// writeEvery writes to conn every interval until stop is closed.
+func writeEvery(conn net.Conn, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestBiCopyIdleTimeout(t *testing.T) {
+	_, done := biCopyPipes(&tunnel{gateway: &Gateway{}, idleTimeout: 100 * time.Millisecond})
+	select {
+	case d := <-done:
+		if d < 100*time.Millisecond {
+			t.Errorf("got closed after %v, want the idle timeout waited for", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection not closed")
+	}
+}
+
+func TestBiCopyIdleTimeoutReset(t *testing.T) {
+	client, done := biCopyPipes(&tunnel{gateway: &Gateway{}, idleTimeout: 200 * time.Millisecond})
+	stop := make(chan struct{})
+	go writeEvery(client, 50*time.Millisecond, stop)
+
+	select {
+	case d := <-done:
+		t.Fatalf("got closed after %v while busy, want the idle timer reset by traffic", d)
+	case <-time.After(600 * time.Millisecond):
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("connection not closed once idle")
+	}
+}
+
+func TestBiCopyMaxLifetime(t *testing.T) {
+	client, done := biCopyPipes(&tunnel{gateway: &Gateway{}, idleTimeout: time.Second, maxLifetime: 200 * time.Millisecond})
+	stop := make(chan struct{})
+	defer close(stop)
+	go writeEvery(client, 20*time.Millisecond, stop)
+
+	select {
+	case d := <-done:
+		if d < 200*time.Millisecond {
+			t.Errorf("got closed after %v, want the max lifetime waited for", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("busy connection not closed at its max lifetime")
+	}
+}